@@ -1,13 +1,15 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/nghialv/promviz/cache"
+	"github.com/nghialv/promviz/config"
 	"github.com/nghialv/promviz/model"
 	"github.com/nghialv/promviz/storage"
 	"github.com/prometheus/client_golang/prometheus"
@@ -28,10 +30,28 @@ type Handler interface {
 }
 
 type Options struct {
-	ListenPort int
-	ConfigFile string
-	Cache      cache.Cache
-	Querier    storage.Querier
+	ListenPort        int
+	ConfigFile        string
+	ConfigLoadOptions *config.LoadOptions
+	EnableConfigWrite bool
+	ConfigManager     ConfigManager
+	ConfigHistory     storage.ConfigHistory
+	RetrievalStatus   RetrievalStatus
+	Cache             cache.Cache
+	Querier           storage.Querier
+}
+
+// ConfigManager provides the currently applied config and dry-runs new ones.
+type ConfigManager interface {
+	Config() *config.Config
+	ValidateConfig(*config.Config) error
+}
+
+// RetrievalStatus provides the status of the queries sent for the latest snapshot
+// and the health of the prometheus server replicas.
+type RetrievalStatus interface {
+	QueryStatus() []*model.QueryStatus
+	ReplicaStatus() []*model.ReplicaStatus
 }
 
 type apiMetrics struct {
@@ -79,8 +99,9 @@ type handler struct {
 	logger  *zap.Logger
 	metrics *apiMetrics
 
-	options  *Options
-	reloadCh chan chan error
+	options   *Options
+	reloadCh  chan chan error
+	configMtx sync.Mutex
 
 	cache   cache.Cache
 	querier storage.Querier
@@ -111,6 +132,11 @@ func (h *handler) Run(g prometheus.Gatherer) error {
 	mux.HandleFunc("/graph", h.getGraphHandler)
 	mux.HandleFunc("/reload", h.reloadHandler)
 	mux.HandleFunc("/config", h.getConfigHandler)
+	mux.HandleFunc("/api/v1/config", h.configHandler)
+	mux.HandleFunc("/api/v1/config/validate", h.validateConfigHandler)
+	mux.HandleFunc("/api/v1/config/history", h.getConfigHistoryHandler)
+	mux.HandleFunc("/api/v1/retrieval/status", h.getRetrievalStatusHandler)
+	mux.HandleFunc("/api/v1/retrieval/replicas", h.getReplicaStatusHandler)
 	mux.Handle("/metrics", promhttp.HandlerFor(g, promhttp.HandlerOpts{}))
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Alive"))
@@ -137,9 +163,7 @@ func (h *handler) reloadHandler(w http.ResponseWriter, r *http.Request) {
 	status := http.StatusOK
 	defer track(h.metrics, "Reload")(&status)
 
-	rc := make(chan error)
-	h.reloadCh <- rc
-	if err := <-rc; err != nil {
+	if err := h.reload(); err != nil {
 		status = http.StatusInternalServerError
 		http.Error(w, fmt.Sprintf("Failed to reload config: %s", err), status)
 		return
@@ -147,6 +171,12 @@ func (h *handler) reloadHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(status)
 }
 
+func (h *handler) reload() error {
+	rc := make(chan error)
+	h.reloadCh <- rc
+	return <-rc
+}
+
 func (h *handler) getGraphHandler(w http.ResponseWriter, req *http.Request) {
 	status := http.StatusOK
 	defer track(h.metrics, "GetGraph")(&status)
@@ -155,6 +185,13 @@ func (h *handler) getGraphHandler(w http.ResponseWriter, req *http.Request) {
 	query := req.URL.Query()
 	offsets := query["offset"]
 
+	filter, err := parseMetadataFilter(query["metadata"])
+	if err != nil {
+		status = http.StatusBadRequest
+		http.Error(w, err.Error(), status)
+		return
+	}
+
 	if len(offsets) != 0 {
 		offset, err := strconv.Atoi(offsets[0])
 		if err != nil {
@@ -206,24 +243,87 @@ func (h *handler) getGraphHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	graphJSON := []byte(snapshot.GraphJSON)
+	if len(filter) != 0 {
+		var graph model.VizceralGraph
+		if err := json.Unmarshal(graphJSON, &graph); err != nil {
+			status = http.StatusInternalServerError
+			http.Error(w, fmt.Sprintf("Failed to decode snapshot: %s", err), status)
+			return
+		}
+		filter.apply(&graph)
+		if graphJSON, err = json.Marshal(&graph); err != nil {
+			status = http.StatusInternalServerError
+			http.Error(w, fmt.Sprintf("Failed to encode graph: %s", err), status)
+			return
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	w.Write([]byte(snapshot.GraphJSON))
+	w.Write(graphJSON)
 }
 
 func (h *handler) getConfigHandler(w http.ResponseWriter, req *http.Request) {
 	status := http.StatusOK
 	defer track(h.metrics, "GetConfig")(&status)
 
-	content, err := ioutil.ReadFile(h.options.ConfigFile)
+	// The applied config is returned instead of the file so that its secrets
+	// and the values expanded from the environment and files are redacted.
+	cfg := h.options.ConfigManager.Config()
+	if cfg == nil {
+		status = http.StatusNotFound
+		http.Error(w, "Config has not been applied", status)
+		return
+	}
+	content, err := cfg.MarshalRedacted()
 	if err != nil {
 		status = http.StatusInternalServerError
 		http.Error(w, err.Error(), status)
+		return
 	}
 
 	w.Write(content)
 }
 
+func (h *handler) getRetrievalStatusHandler(w http.ResponseWriter, req *http.Request) {
+	status := http.StatusOK
+	defer track(h.metrics, "GetRetrievalStatus")(&status)
+
+	queries := h.options.RetrievalStatus.QueryStatus()
+	if queries == nil {
+		queries = []*model.QueryStatus{}
+	}
+	data, err := json.Marshal(queries)
+	if err != nil {
+		status = http.StatusInternalServerError
+		http.Error(w, fmt.Sprintf("Failed to marshal retrieval status: %s", err), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func (h *handler) getReplicaStatusHandler(w http.ResponseWriter, req *http.Request) {
+	status := http.StatusOK
+	defer track(h.metrics, "GetReplicaStatus")(&status)
+
+	replicas := h.options.RetrievalStatus.ReplicaStatus()
+	if replicas == nil {
+		replicas = []*model.ReplicaStatus{}
+	}
+	data, err := json.Marshal(replicas)
+	if err != nil {
+		status = http.StatusInternalServerError
+		http.Error(w, fmt.Sprintf("Failed to marshal replica status: %s", err), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
 func track(metrics *apiMetrics, handler string) func(*int) {
 	start := time.Now()
 	return func(status *int) {
@@ -1 +1,336 @@
 package api
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nghialv/promviz/config"
+	"github.com/nghialv/promviz/model"
+	"github.com/nghialv/promviz/storage/storagemock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type fakeConfigManager struct {
+	cfg *config.Config
+}
+
+func (f *fakeConfigManager) Config() *config.Config {
+	return f.cfg
+}
+
+func (f *fakeConfigManager) ValidateConfig(*config.Config) error {
+	return nil
+}
+
+const testConfig = `graphName: Test
+clusterLevel:
+  - cluster: demo-cluster-1
+    serviceConnections:
+      - query: status:http_requests_total:rate2m
+        prometheusURL: http://localhost:9090
+        source:
+          replacement: INTERNET
+        target:
+          label: service
+          regex: ^demo-(.+)$$
+`
+
+func TestConfigHandlers(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "promviz.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte("graphName: Old\n"), 0644))
+
+	cfg, err := config.Load([]byte(testConfig), &config.LoadOptions{})
+	require.NoError(t, err)
+
+	h := NewHandler(zap.NewNop(), nil, &Options{
+		ConfigFile:        path,
+		ConfigLoadOptions: &config.LoadOptions{},
+		EnableConfigWrite: true,
+		ConfigManager:     &fakeConfigManager{cfg: cfg},
+	}).(*handler)
+	go func() {
+		for rc := range h.reloadCh {
+			rc <- nil
+		}
+	}()
+
+	rec := httptest.NewRecorder()
+	h.configHandler(rec, httptest.NewRequest("GET", "/api/v1/config", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"graphName":"Test"`)
+	assert.Contains(t, rec.Body.String(), `"regex":"^demo-(.+)$"`)
+
+	rec = httptest.NewRecorder()
+	h.validateConfigHandler(rec, httptest.NewRequest("POST", "/api/v1/config/validate", strings.NewReader("graphNam: Typo\n")))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"valid":false`)
+
+	rec = httptest.NewRecorder()
+	h.configHandler(rec, httptest.NewRequest("PUT", "/api/v1/config", strings.NewReader(testConfig)))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, testConfig, string(content))
+
+	// Written configs are validated the way they are loaded, with expansion.
+	t.Setenv("PROMVIZ_TEST_GRAPH_NAME", "FromEnv")
+	written := strings.Replace(testConfig, "graphName: Test", "graphName: ${PROMVIZ_TEST_GRAPH_NAME}", 1)
+	rec = httptest.NewRecorder()
+	h.configHandler(rec, httptest.NewRequest("PUT", "/api/v1/config", strings.NewReader(written)))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	content, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, written, string(content))
+
+	rec = httptest.NewRecorder()
+	h.configHandler(rec, httptest.NewRequest("PUT", "/api/v1/config", strings.NewReader("graphName: ${PROMVIZ_TEST_UNDEFINED}\n")))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "environment variable PROMVIZ_TEST_UNDEFINED is not defined")
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestConfigHandlersRedactSecrets(t *testing.T) {
+	t.Setenv("PROMVIZ_TEST_TOKEN", "token-from-env")
+	cfg, err := config.Load([]byte(`graphName: Test
+prometheusServers:
+  - name: main
+    url: http://localhost:9090/${PROMVIZ_TEST_TOKEN}
+    headers:
+      X-Scope-OrgID: header-secret
+clusterLevel:
+  - cluster: demo-cluster-1
+    serviceConnections:
+      - query: status:http_requests_total:rate2m
+        prometheus: main
+        source:
+          replacement: INTERNET
+        target:
+          label: service
+          regex: ^demo-(.+)$$
+`), &config.LoadOptions{})
+	require.NoError(t, err)
+
+	h := NewHandler(zap.NewNop(), nil, &Options{
+		ConfigLoadOptions: &config.LoadOptions{},
+		ConfigManager:     &fakeConfigManager{cfg: cfg},
+	}).(*handler)
+
+	for _, tc := range []struct {
+		handler http.HandlerFunc
+		target  string
+	}{
+		{h.configHandler, "/api/v1/config"},
+		{h.configHandler, "/api/v1/config?format=yaml"},
+		{h.getConfigHandler, "/config"},
+	} {
+		rec := httptest.NewRecorder()
+		tc.handler(rec, httptest.NewRequest("GET", tc.target, nil))
+		require.Equal(t, http.StatusOK, rec.Code, tc.target)
+		assert.Contains(t, rec.Body.String(), "X-Scope-OrgID", tc.target)
+		assert.NotContains(t, rec.Body.String(), "header-secret", tc.target)
+		assert.NotContains(t, rec.Body.String(), "token-from-env", tc.target)
+	}
+}
+
+func TestValidateConfigHandler(t *testing.T) {
+	t.Setenv("PROMVIZ_TEST_TOKEN", "token-from-env")
+	dir := t.TempDir()
+	path := filepath.Join(dir, "promviz.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte("graphName: Old\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "classes.inc"), []byte("classes:\n  - name: cache\n"), 0644))
+
+	h := NewHandler(zap.NewNop(), nil, &Options{
+		ConfigFile:        path,
+		ConfigLoadOptions: &config.LoadOptions{},
+		ConfigManager:     &fakeConfigManager{},
+	}).(*handler)
+
+	validate := func(content string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.validateConfigHandler(rec, httptest.NewRequest("POST", "/api/v1/config/validate", strings.NewReader(content)))
+		return rec
+	}
+
+	// Relative includes are resolved against the directory of the config file.
+	rec := validate("include:\n  - classes.inc\n" + testConfig)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = validate("include:\n  - classes.inc\nclasses:\n  - name: cache\n" + testConfig)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), `duplicate class \"cache\"`)
+
+	rec = validate("graphName: ${PROMVIZ_TEST_TOKEN}\n")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "line 1: expansion of ${PROMVIZ_TEST_TOKEN} is disabled")
+	assert.NotContains(t, rec.Body.String(), "token-from-env")
+
+	rec = validate("graphName: $__file{promviz.yaml}\n")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "expansion of $__file{promviz.yaml} is disabled")
+
+	// Includes can not read files out of the directory of the config file,
+	// and errors do not show the content of included files.
+	outside := t.TempDir()
+	secret := filepath.Join(outside, "secret.txt")
+	require.NoError(t, ioutil.WriteFile(secret, []byte("db_password=hunter2\n"), 0600))
+	rec = validate("include:\n  - " + secret + "\n")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "must be in "+dir)
+	rec = validate("include:\n  - ../*/secret.txt\n")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "hunter2")
+
+	require.NoError(t, os.Symlink(secret, filepath.Join(dir, "link.inc")))
+	rec = validate("include:\n  - link.inc\n")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "included file must be in "+dir)
+	assert.NotContains(t, rec.Body.String(), "hunter2")
+	require.NoError(t, os.Remove(filepath.Join(dir, "link.inc")))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "secret.inc"), []byte("db_password=hunter2\n"), 0600))
+	rec = validate("include:\n  - secret.inc\n")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "secret.inc: invalid config")
+	assert.NotContains(t, rec.Body.String(), "hunter2")
+	require.NoError(t, os.Remove(filepath.Join(dir, "secret.inc")))
+
+	// Nothing is written next to the config file.
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+}
+
+func TestConfigHistoryHandler(t *testing.T) {
+	ts := time.Unix(1600000000, 0).UTC()
+	history := &storagemock.Storage{}
+	history.On("GetConfigHistory").Return([]*model.ConfigRecord{
+		{
+			Timestamp: ts,
+			Hash:      "abc",
+			Config:    "graphName: Test\n",
+			Changes:   []*model.ConfigChange{{Kind: "changed", Path: "graphName", Old: "Old", New: "Test"}},
+		},
+	}, nil).Once()
+	history.On("GetConfigHistory").Return(nil, errors.New("closed")).Once()
+
+	h := NewHandler(zap.NewNop(), nil, &Options{ConfigHistory: history}).(*handler)
+
+	rec := httptest.NewRecorder()
+	h.getConfigHistoryHandler(rec, httptest.NewRequest("GET", "/api/v1/config/history", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.JSONEq(t, `[{
+		"timestamp": "2020-09-13T12:26:40Z",
+		"hash": "abc",
+		"config": "graphName: Test\n",
+		"changes": [{"kind": "changed", "path": "graphName", "old": "Old", "new": "Test"}]
+	}]`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	h.getConfigHistoryHandler(rec, httptest.NewRequest("GET", "/api/v1/config/history", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	history.AssertExpectations(t)
+}
+
+type fakeRetrievalStatus struct {
+	queries  []*model.QueryStatus
+	replicas []*model.ReplicaStatus
+}
+
+func (f *fakeRetrievalStatus) QueryStatus() []*model.QueryStatus {
+	return f.queries
+}
+
+func (f *fakeRetrievalStatus) ReplicaStatus() []*model.ReplicaStatus {
+	return f.replicas
+}
+
+func TestRetrievalStatusHandler(t *testing.T) {
+	retrieval := &fakeRetrievalStatus{}
+	h := NewHandler(zap.NewNop(), nil, &Options{RetrievalStatus: retrieval}).(*handler)
+
+	// No snapshot has been generated yet.
+	rec := httptest.NewRecorder()
+	h.getRetrievalStatusHandler(rec, httptest.NewRequest("GET", "/api/v1/retrieval/status", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "[]", rec.Body.String())
+
+	retrieval.queries = []*model.QueryStatus{
+		{
+			Cluster:         "cluster-1",
+			Query:           "serviceConnections[0]",
+			Expr:            "requests",
+			Prometheus:      "http://prometheus",
+			LastRun:         time.Unix(1600000000, 0).UTC(),
+			DurationSeconds: 0.5,
+			Error:           "unavailable",
+			Series:          2,
+			DroppedSamples:  1,
+		},
+		{Cluster: "clusterTemplates[0]", Query: "serviceConnections[0]", Expr: "requests", Prometheus: "http://prometheus", Skipped: true},
+	}
+	rec = httptest.NewRecorder()
+	h.getRetrievalStatusHandler(rec, httptest.NewRequest("GET", "/api/v1/retrieval/status", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.JSONEq(t, `[
+		{
+			"cluster": "cluster-1",
+			"query": "serviceConnections[0]",
+			"expr": "requests",
+			"prometheus": "http://prometheus",
+			"lastRun": "2020-09-13T12:26:40Z",
+			"durationSeconds": 0.5,
+			"error": "unavailable",
+			"series": 2,
+			"droppedSamples": 1
+		},
+		{
+			"cluster": "clusterTemplates[0]",
+			"query": "serviceConnections[0]",
+			"expr": "requests",
+			"prometheus": "http://prometheus",
+			"lastRun": "0001-01-01T00:00:00Z",
+			"durationSeconds": 0,
+			"series": 0,
+			"droppedSamples": 0,
+			"skipped": true
+		}
+	]`, rec.Body.String())
+}
+
+func TestReplicaStatusHandler(t *testing.T) {
+	retrieval := &fakeRetrievalStatus{}
+	h := NewHandler(zap.NewNop(), nil, &Options{RetrievalStatus: retrieval}).(*handler)
+
+	rec := httptest.NewRecorder()
+	h.getReplicaStatusHandler(rec, httptest.NewRequest("GET", "/api/v1/retrieval/replicas", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "[]", rec.Body.String())
+
+	retrieval.replicas = []*model.ReplicaStatus{
+		{Prometheus: "ha", URL: "http://prometheus-0:9090", Healthy: false, LastCheck: time.Unix(1600000000, 0).UTC(), LastError: "context deadline exceeded"},
+		{Prometheus: "ha", URL: "http://prometheus-1:9090", Healthy: true, LastCheck: time.Unix(1600000000, 0).UTC()},
+	}
+	rec = httptest.NewRecorder()
+	h.getReplicaStatusHandler(rec, httptest.NewRequest("GET", "/api/v1/retrieval/replicas", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.JSONEq(t, `[
+		{"prometheus": "ha", "url": "http://prometheus-0:9090", "healthy": false, "lastCheck": "2020-09-13T12:26:40Z", "lastError": "context deadline exceeded"},
+		{"prometheus": "ha", "url": "http://prometheus-1:9090", "healthy": true, "lastCheck": "2020-09-13T12:26:40Z"}
+	]`, rec.Body.String())
+}
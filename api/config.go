@@ -0,0 +1,235 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/nghialv/promviz/config"
+	"go.uber.org/zap"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+const maxConfigSize = 10 << 20
+
+type configValidationResult struct {
+	Valid  bool     `json:"valid"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+func (h *handler) configHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		h.getEffectiveConfigHandler(w, req)
+	case "PUT":
+		h.putConfigHandler(w, req)
+	default:
+		http.Error(w, "Invalid request method", http.StatusNotImplemented)
+	}
+}
+
+func (h *handler) getEffectiveConfigHandler(w http.ResponseWriter, req *http.Request) {
+	status := http.StatusOK
+	defer track(h.metrics, "GetEffectiveConfig")(&status)
+
+	cfg := h.options.ConfigManager.Config()
+	if cfg == nil {
+		status = http.StatusNotFound
+		http.Error(w, "Config has not been applied", status)
+		return
+	}
+
+	data, err := cfg.MarshalRedacted()
+	if err != nil {
+		status = http.StatusInternalServerError
+		http.Error(w, fmt.Sprintf("Failed to marshal config: %s", err), status)
+		return
+	}
+
+	if req.URL.Query().Get("format") == "yaml" {
+		w.Header().Set("Content-Type", "application/x-yaml")
+		w.WriteHeader(status)
+		w.Write(data)
+		return
+	}
+
+	// The config is converted through YAML so that JSON keys match the config file.
+	var v interface{}
+	if err = yamlv3.Unmarshal(data, &v); err == nil {
+		data, err = json.Marshal(v)
+	}
+	if err != nil {
+		status = http.StatusInternalServerError
+		http.Error(w, fmt.Sprintf("Failed to marshal config: %s", err), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func (h *handler) validateConfigHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Invalid request method", http.StatusNotImplemented)
+		return
+	}
+
+	status := http.StatusOK
+	defer track(h.metrics, "ValidateConfig")(&status)
+
+	content, err := ioutil.ReadAll(io.LimitReader(req.Body, maxConfigSize))
+	if err != nil {
+		status = http.StatusBadRequest
+		http.Error(w, fmt.Sprintf("Failed to read request body: %s", err), status)
+		return
+	}
+
+	if err := h.validateConfig(content, false); err != nil {
+		status = http.StatusBadRequest
+		writeConfigValidationResult(w, status, err)
+		return
+	}
+	writeConfigValidationResult(w, status, nil)
+}
+
+func (h *handler) putConfigHandler(w http.ResponseWriter, req *http.Request) {
+	status := http.StatusOK
+	defer track(h.metrics, "PutConfig")(&status)
+
+	if !h.options.EnableConfigWrite {
+		status = http.StatusForbidden
+		http.Error(w, "Writing config is disabled (--api.enable-config-write)", status)
+		return
+	}
+	if fi, err := os.Stat(h.options.ConfigFile); err == nil && fi.IsDir() {
+		status = http.StatusBadRequest
+		http.Error(w, "Unable to write config when the config file is a directory", status)
+		return
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(req.Body, maxConfigSize))
+	if err != nil {
+		status = http.StatusBadRequest
+		http.Error(w, fmt.Sprintf("Failed to read request body: %s", err), status)
+		return
+	}
+
+	h.configMtx.Lock()
+	defer h.configMtx.Unlock()
+
+	// The content is validated the way it is loaded once written, as
+	// writing the config is already trusted with the files of the server.
+	if err := h.validateConfig(content, true); err != nil {
+		status = http.StatusBadRequest
+		writeConfigValidationResult(w, status, err)
+		return
+	}
+
+	if err := writeConfigFile(h.options.ConfigFile, content); err != nil {
+		status = http.StatusInternalServerError
+		http.Error(w, fmt.Sprintf("Failed to write config: %s", err), status)
+		return
+	}
+	h.logger.Info("Wrote new configuration", zap.String("filepath", h.options.ConfigFile))
+
+	if err := h.reload(); err != nil {
+		status = http.StatusInternalServerError
+		http.Error(w, fmt.Sprintf("Failed to reload config: %s", err), status)
+		return
+	}
+	writeConfigValidationResult(w, status, nil)
+}
+
+func (h *handler) getConfigHistoryHandler(w http.ResponseWriter, req *http.Request) {
+	status := http.StatusOK
+	defer track(h.metrics, "GetConfigHistory")(&status)
+
+	records, err := h.options.ConfigHistory.GetConfigHistory()
+	if err != nil {
+		status = http.StatusInternalServerError
+		http.Error(w, fmt.Sprintf("Failed to get config history: %s", err), status)
+		return
+	}
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		status = http.StatusInternalServerError
+		http.Error(w, fmt.Sprintf("Failed to marshal config history: %s", err), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// validateConfig dry-runs loading and applying content in memory as if it
+// were the config file. Unless expansion is enabled, references to
+// environment variables and files are rejected and includes are restricted
+// to the directory of the config file, so that neither can be read through
+// the API.
+func (h *handler) validateConfig(content []byte, expansion bool) error {
+	opts := config.LoadOptions{}
+	if h.options.ConfigLoadOptions != nil {
+		opts = *h.options.ConfigLoadOptions
+	}
+	if fi, err := os.Stat(h.options.ConfigFile); err == nil && fi.IsDir() {
+		opts.Dir = h.options.ConfigFile
+	} else {
+		opts.File = h.options.ConfigFile
+	}
+	opts.DisableExpansion = !expansion
+
+	cfg, err := config.Load(content, &opts)
+	if err != nil {
+		return err
+	}
+	return h.options.ConfigManager.ValidateConfig(cfg)
+}
+
+// writeConfigFile atomically replaces the config file at path with content
+// by renaming a temporary file written next to it.
+func writeConfigFile(path string, content []byte) error {
+	// The suffix keeps the file out of include globs such as *.yaml.
+	f, err := ioutil.TempFile(filepath.Dir(path), ".promviz-*.yaml.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+
+	_, err = f.Write(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+func writeConfigValidationResult(w http.ResponseWriter, status int, err error) {
+	result := configValidationResult{
+		Valid: err == nil,
+	}
+	if errs, ok := err.(config.Errors); ok {
+		for _, e := range errs {
+			result.Errors = append(result.Errors, e.Error())
+		}
+	} else if err != nil {
+		result.Errors = []string{err.Error()}
+	}
+
+	data, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
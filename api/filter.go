@@ -0,0 +1,83 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nghialv/promviz/model"
+)
+
+// metadataFilter matches the nodes having all of its labels in their metadata.
+type metadataFilter map[string]string
+
+// parseMetadataFilter parses the values of the metadata parameter of the
+// graph endpoint, each of them in the form key=value.
+func parseMetadataFilter(params []string) (metadataFilter, error) {
+	filter := make(metadataFilter, len(params))
+	for _, p := range params {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("Invalid metadata filter (%s): must be key=value", p)
+		}
+		filter[kv[0]] = kv[1]
+	}
+	return filter, nil
+}
+
+func (f metadataFilter) match(node *model.Node) bool {
+	if node.Metadata == nil {
+		return false
+	}
+	for k, v := range f {
+		if lv, ok := node.Metadata.Labels[k]; !ok || lv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// apply filters the nodes inside every node of the graph, e.g. the services of
+// each cluster, keeping the matching nodes, the connections from or to them and
+// the nodes on the other side of these connections. The nodes of the graph
+// itself are kept as they have no metadata labels, and so are the nodes of
+// child levels, e.g. namespaces, which contain a matching node.
+func (f metadataFilter) apply(graph *model.VizceralGraph) {
+	for _, node := range graph.Nodes {
+		f.filterNode(node)
+	}
+}
+
+// filterNode filters the nodes inside parent and reports whether any of
+// them or of the nodes inside them matches.
+func (f metadataFilter) filterNode(parent *model.Node) bool {
+	if len(parent.Nodes) == 0 {
+		return false
+	}
+
+	matched := make(map[string]bool)
+	for _, n := range parent.Nodes {
+		if f.filterNode(n) || f.match(n) {
+			matched[n.Name] = true
+		}
+	}
+
+	kept := make(map[string]bool, len(matched))
+	connections := make([]*model.Connection, 0)
+	for _, c := range parent.Connections {
+		if matched[c.Source] || matched[c.Target] {
+			connections = append(connections, c)
+			kept[c.Source] = true
+			kept[c.Target] = true
+		}
+	}
+
+	nodes := make([]*model.Node, 0, len(kept))
+	for _, n := range parent.Nodes {
+		if matched[n.Name] || kept[n.Name] {
+			nodes = append(nodes, n)
+		}
+	}
+	parent.Nodes = nodes
+	parent.Connections = connections
+	return len(matched) > 0
+}
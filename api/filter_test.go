@@ -0,0 +1,106 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nghialv/promviz/model"
+	"github.com/nghialv/promviz/storage/storagemock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestGraphMetadataFilter(t *testing.T) {
+	node := func(name string, labels map[string]string) *model.Node {
+		return &model.Node{Name: name, Metadata: &model.Metadata{Streaming: 1, Labels: labels}}
+	}
+	graph := &model.VizceralGraph{
+		Renderer: "global",
+		Name:     "edge",
+		Nodes: []*model.Node{
+			{
+				Name: "cluster-1",
+				Nodes: []*model.Node{
+					node("INTERNET", nil),
+					node("web", map[string]string{"team": "frontend"}),
+					node("payments", map[string]string{"team": "payments", "version": "v2"}),
+					node("search", map[string]string{"team": "search"}),
+					node("db", nil),
+					{
+						// A namespace has no metadata labels, but the services inside it do.
+						Name: "shop",
+						Nodes: []*model.Node{
+							node("orders", map[string]string{"team": "payments"}),
+							node("cart", map[string]string{"team": "frontend"}),
+							node("reviews", map[string]string{"team": "search"}),
+						},
+						Connections: []*model.Connection{
+							{Source: "orders", Target: "cart"},
+							{Source: "reviews", Target: "cart"},
+						},
+					},
+				},
+				Connections: []*model.Connection{
+					{Source: "INTERNET", Target: "web"},
+					{Source: "web", Target: "payments"},
+					{Source: "web", Target: "search"},
+					{Source: "payments", Target: "db"},
+					{Source: "INTERNET", Target: "shop"},
+				},
+			},
+		},
+	}
+	data, err := json.Marshal(graph)
+	require.NoError(t, err)
+
+	querier := &storagemock.Storage{}
+	querier.On("GetLatestSnapshot").Return(&model.Snapshot{GraphJSON: string(data)}, nil)
+	h := NewHandler(zap.NewNop(), nil, &Options{Querier: querier}).(*handler)
+
+	get := func(target string) (int, *model.VizceralGraph) {
+		w := httptest.NewRecorder()
+		h.getGraphHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusOK {
+			return w.Code, nil
+		}
+		var g model.VizceralGraph
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &g))
+		return w.Code, &g
+	}
+	names := func(g *model.VizceralGraph) []string {
+		ns := make([]string, 0)
+		for _, n := range g.Nodes[0].Nodes {
+			ns = append(ns, n.Name)
+		}
+		return ns
+	}
+
+	code, g := get("/graph")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, graph, g)
+
+	code, g = get("/graph?metadata=team=payments")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"INTERNET", "web", "payments", "db", "shop"}, names(g))
+	assert.Equal(t, []*model.Connection{
+		{Source: "web", Target: "payments"},
+		{Source: "payments", Target: "db"},
+		{Source: "INTERNET", Target: "shop"},
+	}, g.Nodes[0].Connections)
+	shop := g.Nodes[0].Nodes[4]
+	require.Len(t, shop.Nodes, 2)
+	assert.Equal(t, "orders", shop.Nodes[0].Name)
+	assert.Equal(t, "cart", shop.Nodes[1].Name)
+	assert.Equal(t, []*model.Connection{{Source: "orders", Target: "cart"}}, shop.Connections)
+
+	code, g = get("/graph?metadata=team=payments&metadata=version=v1")
+	require.Equal(t, http.StatusOK, code)
+	assert.Empty(t, names(g))
+	assert.Empty(t, g.Nodes[0].Connections)
+
+	code, _ = get("/graph?metadata=team")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
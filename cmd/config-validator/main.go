@@ -1,5 +1,93 @@
 package main
 
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/nghialv/promviz/config"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
 func main() {
+	var files []string
+	opts := config.LoadOptions{}
+
+	a := kingpin.New(filepath.Base(os.Args[0]), "The offline linter for Promviz configuration files")
+	a.HelpFlag.Short('h')
+
+	a.Arg("config-files", "Promviz configuration files or directories to be validated.").
+		Required().StringsVar(&files)
+
+	a.Flag("config.allow-unknown-fields", "Ignore keys that are not read by any configuration field.").
+		Default("false").BoolVar(&opts.AllowUnknownFields)
+
+	_, err := a.Parse(os.Args[1:])
+	if err != nil {
+		fmt.Printf("Failed to parse arguments: %v\n", err)
+		a.Usage(os.Args[1:])
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, f := range files {
+		if !validate(f, &opts) {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func validate(path string, opts *config.LoadOptions) bool {
+	var errs []error
+	cfg, err := config.LoadFileWithOptions(path, opts)
+	switch err := err.(type) {
+	case nil:
+		errs = cfg.Validate()
+	case config.Errors:
+		// Only queries are invalid, so the config is loaded and Validate
+		// reports them along with the other problems.
+		errs = err
+		if cfg != nil {
+			errs = cfg.Validate()
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return false
+	}
+
+	if len(errs) == 0 {
+		fmt.Printf("%s: OK\n", path)
+		return true
+	}
+
+	for _, err := range errs {
+		verr, ok := err.(*config.ValidationError)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			continue
+		}
+
+		file := verr.File
+		if file == "" {
+			file = path
+		}
+		if line := lineOf(file, verr.Path); line > 0 {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s: %s\n", file, line, verr.Path, verr.Message)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %s: %s\n", file, verr.Path, verr.Message)
+		}
+	}
+	return false
+}
 
+func lineOf(file, path string) int {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0
+	}
+	return config.LineOf(content, path)
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/nghialv/promviz/config"
+	"github.com/nghialv/promviz/retrieval"
+	"github.com/nghialv/promviz/storage"
+	"go.uber.org/zap"
+)
+
+type backfillFlags struct {
+	from string
+	to   string
+	step time.Duration
+}
+
+func runBackfill(logger *zap.Logger, flags *backfillFlags, configFile string, loadOpts *config.LoadOptions, storagePath string, storageOpts *storage.Options, retrievalOpts *retrieval.Options) error {
+	now := time.Now()
+	from, err := parseTime(flags.from, now)
+	if err != nil {
+		return fmt.Errorf("Invalid --from: %v", err)
+	}
+	to, err := parseTime(flags.to, now)
+	if err != nil {
+		return fmt.Errorf("Invalid --to: %v", err)
+	}
+
+	// The current chunk is written by the running server.
+	liveChunk := time.Unix(storage.ChunkID(now), 0)
+	if !to.Before(liveChunk) {
+		to = liveChunk.Add(-time.Second)
+		logger.Info("Backfilling until the current chunk", zap.Time("to", to))
+	}
+	if from.Before(now.Add(-storageOpts.Retention)) {
+		logger.Warn("Snapshots older than the retention will be removed by the server",
+			zap.Duration("retention", storageOpts.Retention))
+	}
+
+	cfg, err := config.LoadFileWithOptions(configFile, loadOpts)
+	if err != nil {
+		return fmt.Errorf("Failed to load configuration (--config.file=%s): %v", configFile, err)
+	}
+
+	backfiller, err := storage.NewBackfiller(storagePath, logger.With(zap.String("component", "storage")))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		logger.Warn("Received SIGTERM, stopping backfill...")
+		cancel()
+	}()
+
+	logger.Info("Starting backfill",
+		zap.Time("from", from),
+		zap.Time("to", to),
+		zap.Duration("step", flags.step))
+
+	err = retrieval.Backfill(ctx, logger.With(zap.String("component", "retrieval")), cfg, &retrieval.BackfillOptions{
+		From:            from,
+		To:              to,
+		Step:            flags.step,
+		ScrapeTimeout:   retrievalOpts.ScrapeTimeout,
+		StalenessWindow: retrievalOpts.StalenessWindow,
+		Appender:        backfiller,
+	})
+	if cerr := backfiller.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// parseTime parses an RFC3339 time, unix seconds or "now".
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "now" {
+		return now, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
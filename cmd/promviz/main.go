@@ -29,6 +29,7 @@ var (
 func main() {
 	cfg := struct {
 		configFile  string
+		configLoad  config.LoadOptions
 		logLevel    string
 		storagePath string
 
@@ -36,27 +37,37 @@ func main() {
 		retrieval retrieval.Options
 		cache     cache.Options
 		storage   storage.Options
+		backfill  backfillFlags
 	}{}
 
 	a := kingpin.New(filepath.Base(os.Args[0]), "The Promviz server")
 	a.Version(version.Version)
 	a.HelpFlag.Short('h')
 
-	a.Flag("config.file", "Promviz configuration file path.").
+	a.Flag("config.file", "Promviz configuration file path. When a directory is given, every YAML file in it is loaded and merged.").
 		Default("/etc/promviz/promviz.yaml").StringVar(&cfg.configFile)
 
+	a.Flag("config.allow-unknown-fields", "Ignore keys in the configuration file that are not read by any field.").
+		Default("false").BoolVar(&cfg.configLoad.AllowUnknownFields)
+
 	a.Flag("log.level", "The level of logging.").
 		Default("info").StringVar(&cfg.logLevel)
 
 	a.Flag("api.port", "Port to listen on for API requests.").
 		Default("9091").IntVar(&cfg.api.ListenPort)
 
+	a.Flag("api.enable-config-write", "Enable PUT /api/v1/config to overwrite the configuration file and reload it.").
+		Default("false").BoolVar(&cfg.api.EnableConfigWrite)
+
 	a.Flag("retrieval.scrape-interval", "How frequently to scrape metrics from prometheus servers.").
 		Default("10s").DurationVar(&cfg.retrieval.ScrapeInterval)
 
 	a.Flag("retrieval.scrape-timeout", "How long until a scrape request times out.").
 		Default("8s").DurationVar(&cfg.retrieval.ScrapeTimeout)
 
+	a.Flag("retrieval.staleness-window", "How long the last successful result of a failing query with onError: reuseLast is reused.").
+		Default("5m").DurationVar(&cfg.retrieval.StalenessWindow)
+
 	a.Flag("cache.size", "The maximum number of snapshots can be cached.").
 		Default("100").IntVar(&cfg.cache.Size)
 
@@ -66,7 +77,20 @@ func main() {
 	a.Flag("storage.retention", "How long to retain graph data in the storage.").
 		Default("168h").DurationVar(&cfg.storage.Retention)
 
-	_, err := a.Parse(os.Args[1:])
+	a.Flag("storage.config-history-size", "The maximum number of applied configurations kept in the config history.").
+		Default("20").IntVar(&cfg.storage.ConfigHistorySize)
+
+	a.Command("serve", "Run the Promviz server.").Default()
+
+	backfillCmd := a.Command("backfill", "Generate snapshots for past timestamps into the storage.")
+	backfillCmd.Flag("from", "The first timestamp to backfill (RFC3339 or unix seconds).").
+		Required().StringVar(&cfg.backfill.from)
+	backfillCmd.Flag("to", "The last timestamp to backfill (RFC3339, unix seconds or now).").
+		Default("now").StringVar(&cfg.backfill.to)
+	backfillCmd.Flag("step", "The interval between backfilled snapshots.").
+		Default("1m").DurationVar(&cfg.backfill.step)
+
+	cmd, err := a.Parse(os.Args[1:])
 	if err != nil {
 		fmt.Printf("Failed to parse arguments: %v\n", err)
 		a.Usage(os.Args[1:])
@@ -80,6 +104,16 @@ func main() {
 	}
 	defer logger.Sync()
 
+	if cmd == backfillCmd.FullCommand() {
+		err := runBackfill(logger, &cfg.backfill, cfg.configFile, &cfg.configLoad, cfg.storagePath, &cfg.storage, &cfg.retrieval)
+		if err != nil {
+			logger.Error("Failed to backfill", zap.Error(err))
+			logger.Sync()
+			os.Exit(1)
+		}
+		return
+	}
+
 	registry := prometheus.NewRegistry()
 	registry.MustRegister(
 		prometheus.NewGoCollector(),
@@ -105,8 +139,11 @@ func main() {
 	defer db.Close()
 
 	cfg.api.ConfigFile = cfg.configFile
+	cfg.api.ConfigLoadOptions = &cfg.configLoad
 	cfg.api.Querier = db
+	cfg.api.ConfigHistory = db
 	cfg.retrieval.Appender = db
+	cfg.retrieval.ConfigHistory = db
 
 	retriever := retrieval.NewRetriever(
 		logger.With(zap.String("component", "retrieval")),
@@ -114,7 +151,7 @@ func main() {
 		&cfg.retrieval,
 	)
 
-	if err := reloadConfig(cfg.configFile, logger, retriever); err != nil {
+	if err := reloadConfig(cfg.configFile, &cfg.configLoad, logger, retriever); err != nil {
 		logger.Error("Failed to run first reloading config", zap.Error(err))
 	}
 
@@ -129,6 +166,8 @@ func main() {
 	defer cache.Reset()
 
 	cfg.api.Cache = cache
+	cfg.api.ConfigManager = retriever
+	cfg.api.RetrievalStatus = retriever
 	apiHandler := api.NewHandler(
 		logger.With(zap.String("component", "api")),
 		registry,
@@ -148,7 +187,7 @@ func main() {
 	go func() {
 		for {
 			rc := <-apiHandler.Reload()
-			if err := reloadConfig(cfg.configFile, logger, retriever); err != nil {
+			if err := reloadConfig(cfg.configFile, &cfg.configLoad, logger, retriever); err != nil {
 				logger.Error("Failed to reload config", zap.Error(err))
 				rc <- err
 			} else {
@@ -172,7 +211,7 @@ type Reloadable interface {
 	ApplyConfig(*config.Config) error
 }
 
-func reloadConfig(path string, logger *zap.Logger, rl Reloadable) (err error) {
+func reloadConfig(path string, opts *config.LoadOptions, logger *zap.Logger, rl Reloadable) (err error) {
 	logger.Info("Loading configuration file", zap.String("filepath", path))
 
 	defer func() {
@@ -183,7 +222,7 @@ func reloadConfig(path string, logger *zap.Logger, rl Reloadable) (err error) {
 		}
 	}()
 
-	cfg, err := config.LoadFile(path)
+	cfg, err := config.LoadFileWithOptions(path, opts)
 	if err != nil {
 		return fmt.Errorf("Failed to load configuration (--config.file=%s): %v", path, err)
 	}
@@ -4,27 +4,172 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 
+	promconfig "github.com/prometheus/common/config"
+	prommodel "github.com/prometheus/common/model"
 	yaml "gopkg.in/yaml.v2"
 )
 
+type LoadOptions struct {
+	// AllowUnknownFields disables strict decoding so that keys which are not
+	// read by any field are silently ignored instead of failing the load.
+	AllowUnknownFields bool
+	// Dir is the directory against which Load resolves relative
+	// $__file{path} references, include patterns and file paths. It
+	// defaults to the current working directory.
+	Dir string
+	// File is the path of the config file whose content is given to Load.
+	// Unless Dir is set, Load resolves relative paths against its
+	// directory, and its include patterns never include it.
+	File string
+	// DisableExpansion makes Load reject ${ENV_VAR} and $__file{path}
+	// references in the given content instead of expanding them, e.g. for
+	// content submitted over the API. Its include patterns are then
+	// restricted to the directory of the content, and errors of included
+	// files are reported without their content. Included files are still
+	// expanded.
+	DisableExpansion bool
+}
+
 func LoadFile(path string) (*Config, error) {
+	return LoadFileWithOptions(path, &LoadOptions{})
+}
+
+// LoadFileWithOptions loads the config file placed at path. When path is a
+// directory, every YAML file in it is loaded and merged as if they were
+// included by an empty config file. On invalid queries, the config is
+// returned with the Errors of the queries.
+func LoadFileWithOptions(path string, opts *LoadOptions) (*Config, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		cfg := &Config{
+			Include: []string{"*.yaml", "*.yml"},
+		}
+		if err := cfg.include(path, "", false, opts); err != nil {
+			return nil, err
+		}
+		return build(cfg, opts)
+	}
+
+	cfg, err := decodeFile(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.include(filepath.Dir(path), path, false, opts); err != nil {
+		return nil, err
+	}
+	return build(cfg, opts)
+}
+
+// Load parses the given content. Relative $__file{path} references and
+// include patterns are resolved against opts.Dir, or the directory of
+// opts.File.
+func Load(content []byte, opts *LoadOptions) (*Config, error) {
+	dir := opts.Dir
+	if dir == "" && opts.File != "" {
+		dir = filepath.Dir(opts.File)
+	}
+	cfg, err := decode(content, dir, !opts.DisableExpansion, opts)
+	if err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		cfg.SetDirectory(dir)
+	}
+	if err := cfg.include(dir, opts.File, opts.DisableExpansion, opts); err != nil {
+		return nil, err
+	}
+	return build(cfg, opts)
+}
+
+func decodeFile(path string, opts *LoadOptions) (*Config, error) {
 	content, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	cfg := &Config{}
-	*cfg = DefaultConfig
+	dir := filepath.Dir(path)
+	cfg, err := decode(content, dir, true, opts)
+	if err != nil {
+		return nil, err
+	}
+	cfg.SetDirectory(dir)
+	return cfg, nil
+}
 
-	err = yaml.Unmarshal(content, cfg)
+func decode(content []byte, dir string, expansion bool, opts *LoadOptions) (*Config, error) {
+	content, expanded, err := expand(content, dir, expansion)
 	if err != nil {
 		return nil, err
 	}
+
+	unmarshal := yaml.UnmarshalStrict
+	if opts.AllowUnknownFields {
+		unmarshal = yaml.Unmarshal
+	}
+
+	cfg := &Config{}
+	err = unmarshal(content, cfg)
+	if err != nil {
+		return nil, annotateUnknownFields(content, err)
+	}
+	cfg.markExpanded(content, expanded)
 	return cfg, nil
 }
 
+// build applies defaults to cfg, into which the included files are merged,
+// and resolves references between the sections of the merged config. When
+// only queries are invalid, the loaded config is returned along with their
+// Errors so that it can still be validated.
+func build(cfg *Config, opts *LoadOptions) (*Config, error) {
+	if cfg.GraphName == "" {
+		cfg.GraphName = DefaultConfig.GraphName
+	}
+	if err := cfg.resolvePrometheusServers(); err != nil {
+		return nil, cfg.locate(err)
+	}
+	if err := cfg.ValidateQueries(); err != nil {
+		return cfg, cfg.locate(err)
+	}
+	return cfg, nil
+}
+
+var unknownFieldRegexp = regexp.MustCompile(`^line (\d+): field (\S+) not found in type \S+$`)
+
+// annotateUnknownFields rewrites the unknown field errors of strict decoding
+// to contain the YAML path of each unknown key.
+func annotateUnknownFields(content []byte, err error) error {
+	terr, ok := err.(*yaml.TypeError)
+	if !ok {
+		return err
+	}
+
+	msgs := make([]string, 0, len(terr.Errors))
+	for _, e := range terr.Errors {
+		m := unknownFieldRegexp.FindStringSubmatch(e)
+		if m == nil {
+			msgs = append(msgs, e)
+			continue
+		}
+		line, _ := strconv.Atoi(m[1])
+		path := pathOf(content, line, m[2])
+		if path == "" {
+			msgs = append(msgs, e)
+			continue
+		}
+		msgs = append(msgs, fmt.Sprintf("line %d: unknown field %s", line, path))
+	}
+	return fmt.Errorf("yaml: unmarshal errors:\n  %s", strings.Join(msgs, "\n  "))
+}
+
 var (
 	DefaultConfig = Config{
 		GraphName: "promviz",
@@ -37,42 +182,277 @@ var (
 		Class:       "default",
 	}
 
+	DefaultNodeGroup = NodeGroup{
+		Regex:       MustNewRegexp("^(.+)$"),
+		Replacement: "$1",
+	}
+
 	DefaultClass = Class{
 		Name:  "default",
 		Color: "rgb(186, 213, 237)",
 	}
+
+	// StaleClass is the class of connections generated from reused query results.
+	StaleClass = Class{
+		Name:  "stale",
+		Color: "rgb(120, 120, 120)",
+	}
+
+	DefaultPrometheusServer = PrometheusServer{
+		HTTPClientConfig: promconfig.DefaultHTTPClientConfig,
+	}
 )
 
 type Config struct {
-	GraphName    string      `yaml:"graphName"`
-	GlobalLevel  GlobalLevel `yaml:"globalLevel"`
-	ClusterLevel []*Cluster  `yaml:"clusterLevel"`
-	Classes      []*Class    `yaml:"classes,omitempty"`
+	Include           []string            `yaml:"include,omitempty"`
+	GraphName         string              `yaml:"graphName"`
+	PrometheusServers []*PrometheusServer `yaml:"prometheusServers,omitempty"`
+	DefaultPrometheus string              `yaml:"defaultPrometheus,omitempty"`
+	GlobalLevel       GlobalLevel         `yaml:"globalLevel"`
+	ClusterLevel      []*Cluster          `yaml:"clusterLevel"`
+	ClusterTemplates  []*ClusterTemplate  `yaml:"clusterTemplates,omitempty"`
+	Classes           []*Class            `yaml:"classes,omitempty"`
+
+	// origins maps the path of each merged element to the file declaring it.
+	origins map[string]origin
+	// expanded are the paths of the values written with environment
+	// variables or files substituted while loading, which are redacted when
+	// the config is shown.
+	expanded map[string]struct{}
+}
+
+// SetDirectory joins any relative file paths of the prometheus servers and
+// static connections with dir.
+func (c *Config) SetDirectory(dir string) {
+	for _, s := range c.PrometheusServers {
+		s.HTTPClientConfig.SetDirectory(dir)
+	}
+	setFiles := func(conns []*Connection) {
+		for _, conn := range conns {
+			if conn.File != "" && !filepath.IsAbs(conn.File) {
+				conn.File = filepath.Join(dir, conn.File)
+			}
+		}
+	}
+	setClusterFiles := func(path string, cluster *Cluster) {
+		setFiles(cluster.Connections)
+	}
+	setFiles(c.GlobalLevel.Connections)
+	for _, cluster := range c.ClusterLevel {
+		cluster.Walk("", setClusterFiles)
+	}
+	for _, ct := range c.ClusterTemplates {
+		if ct.Template != nil {
+			ct.Template.Walk("", setClusterFiles)
+		}
+	}
+}
+
+// PrometheusServer is a prometheus compatible endpoint that connections and
+// notices refer to by name. Credentials should be read from files so that
+// they can be mounted from k8s Secrets. ExternalURL, when set, is used instead
+// of URL to build the query links shown in the UI. MaxConcurrentQueries and
+// QueryRateLimit (queries per second) throttle the queries sent to the
+// server; zero means no limit. Replicas replaces URL for a server run as
+// identical replicas, e.g. an HA pair, which are queried as ReplicaStrategy says.
+type PrometheusServer struct {
+	Name                 string                       `yaml:"name"`
+	URL                  string                       `yaml:"url,omitempty"`
+	Replicas             []string                     `yaml:"replicas,omitempty"`
+	ReplicaStrategy      ReplicaStrategy              `yaml:"replicaStrategy,omitempty"`
+	ExternalURL          string                       `yaml:"externalURL,omitempty"`
+	Headers              map[string]promconfig.Secret `yaml:"headers,omitempty"`
+	MaxConcurrentQueries int                          `yaml:"maxConcurrentQueries,omitempty"`
+	QueryRateLimit       float64                      `yaml:"queryRateLimit,omitempty"`
+
+	HTTPClientConfig promconfig.HTTPClientConfig `yaml:",inline"`
+}
+
+func (ps *PrometheusServer) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*ps = DefaultPrometheusServer
+	type plain PrometheusServer
+	return unmarshal((*plain)(ps))
+}
+
+// URLs returns the addresses of the replicas of the server, or its URL.
+func (ps *PrometheusServer) URLs() []string {
+	if len(ps.Replicas) > 0 {
+		return ps.Replicas
+	}
+	return []string{ps.URL}
+}
+
+const (
+	ReplicaFailover   ReplicaStrategy = "failover"
+	ReplicaMostSeries ReplicaStrategy = "mostSeries"
+)
+
+// ReplicaStrategy is how the replicas of a prometheus server are queried:
+// failover tries them one by one, healthy ones first, until one succeeds and
+// mostSeries queries all of them and uses the result with the most series,
+// which fills the gaps one replica has while it was restarting.
+type ReplicaStrategy string
+
+func (rs *ReplicaStrategy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	switch v := ReplicaStrategy(s); v {
+	case ReplicaFailover, ReplicaMostSeries:
+		*rs = v
+		return nil
+	}
+	return fmt.Errorf("Invalid replicaStrategy %q, must be one of failover or mostSeries", s)
 }
 
+// The vizceral renderers a level of the graph can be shown with.
+const (
+	RendererGlobal       = "global"
+	RendererRegion       = "region"
+	RendererFocused      = "focused"
+	RendererFocusedChild = "focusedChild"
+	RendererDNS          = "dns"
+)
+
 type GlobalLevel struct {
-	MaxVolume   float64       `yaml:"maxVolume,omitempty"`
-	Connections []*Connection `yaml:"clusterConnections,omitempty"`
+	// Renderer is the renderer of the whole graph. Default: global
+	Renderer     string         `yaml:"renderer,omitempty"`
+	MaxVolume    float64        `yaml:"maxVolume,omitempty"`
+	Connections  []*Connection  `yaml:"clusterConnections,omitempty"`
+	AlertNotices []*AlertNotice `yaml:"alertNotices,omitempty"`
 }
 
+// Cluster generates the nodes and connections inside the node named Cluster
+// of the level above. Nodes of its graph which are themselves made of nodes,
+// e.g. the namespaces of a cluster, are declared in ChildLevel with the same
+// fields, to any depth. Renderer is the renderer of the node. Default: region
 type Cluster struct {
-	Cluster     string        `yaml:"cluster"`
-	MaxVolume   float64       `yaml:"maxVolume,omitempty"`
-	Connections []*Connection `yaml:"serviceConnections,omitempty"`
-	NodeNotices []*NodeNotice `yaml:"serviceNotices,omitempty"`
+	Cluster           string         `yaml:"cluster"`
+	Renderer          string         `yaml:"renderer,omitempty"`
+	MaxVolume         float64        `yaml:"maxVolume,omitempty"`
+	DefaultPrometheus string         `yaml:"defaultPrometheus,omitempty"`
+	Connections       []*Connection  `yaml:"serviceConnections,omitempty"`
+	NodeNotices       []*NodeNotice  `yaml:"serviceNotices,omitempty"`
+	AlertNotices      []*AlertNotice `yaml:"alertNotices,omitempty"`
+	NodeMetadata      []*NodeMeta    `yaml:"serviceMetadata,omitempty"`
+	Groups            []*NodeGroup   `yaml:"groups,omitempty"`
+	ChildLevel        []*Cluster     `yaml:"childLevel,omitempty"`
+}
+
+// NodeGroup collapses the nodes of a cluster into one node per group. The
+// group of a node is Replacement expanded with the match of Regex against
+// the node name or, when Label is set, the value of the metadata label of
+// the node. Nodes which do not match are not grouped. With DrillDown, the
+// grouped nodes and their connections are kept inside the group node.
+type NodeGroup struct {
+	Label       string `yaml:"label,omitempty"`
+	Regex       Regexp `yaml:"regex,omitempty"`
+	Replacement string `yaml:"replacement,omitempty"`
+	Class       string `yaml:"class,omitempty"`
+	DrillDown   bool   `yaml:"drillDown,omitempty"`
+}
+
+func (ng *NodeGroup) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*ng = DefaultNodeGroup
+	type plain NodeGroup
+	return unmarshal((*plain)(ng))
+}
+
+// Walk calls fn with the cluster and then with every cluster of its child
+// levels, depth first. The path of a child is the path of its parent
+// followed by .childLevel[i].
+func (c *Cluster) Walk(path string, fn func(path string, cluster *Cluster)) {
+	fn(path, c)
+	for i, child := range c.ChildLevel {
+		child.Walk(fmt.Sprintf("%s.childLevel[%d]", path, i), fn)
+	}
+}
+
+const (
+	ConnectionTypePrometheus = "prometheus"
+	ConnectionTypeStatic     = "static"
+	ConnectionTypeJSON       = "json"
+	ConnectionTypeJaeger     = "jaeger"
+)
+
+var (
+	connectionTypesMtx sync.RWMutex
+	connectionTypes    = map[string]struct{}{
+		ConnectionTypePrometheus: {},
+		ConnectionTypeStatic:     {},
+		ConnectionTypeJSON:       {},
+		ConnectionTypeJaeger:     {},
+	}
+)
+
+// RegisterConnectionType makes Validate accept the connections of the given
+// type. It is called for the data sources registered in the retrieval package.
+func RegisterConnectionType(typ string) {
+	connectionTypesMtx.Lock()
+	defer connectionTypesMtx.Unlock()
+	connectionTypes[typ] = struct{}{}
 }
 
+func isConnectionType(typ string) bool {
+	connectionTypesMtx.RLock()
+	defer connectionTypesMtx.RUnlock()
+	_, ok := connectionTypes[typ]
+	return ok
+}
+
+// Connection generates connections from the samples of its data source.
+// Type selects the data source: prometheus (the default) evaluates Query,
+// static reads the edge list in File, json fetches the edge list from URL
+// and jaeger fetches the dependency links of the last Lookback from the
+// jaeger query service at URL.
 type Connection struct {
+	Type          string              `yaml:"type,omitempty"`
 	Query         string              `yaml:"query,omitempty"`
+	Prometheus    string              `yaml:"prometheus,omitempty"`
 	PrometheusURL string              `yaml:"prometheusURL,omitempty"`
+	File          string              `yaml:"file,omitempty"`
+	URL           string              `yaml:"url,omitempty"`
+	Lookback      prommodel.Duration  `yaml:"lookback,omitempty"`
 	Source        *NodeMapping        `yaml:"source,omitempty"`
 	Target        *NodeMapping        `yaml:"target,omitempty"`
 	Status        *Status             `yaml:"status,omitempty"`
+	Metrics       []*ConnectionMetric `yaml:"metrics,omitempty"`
 	Notices       []*ConnectionNotice `yaml:"notices,omitempty"`
+	QueryPolicy   `yaml:",inline"`
+
+	externalURL string
+}
+
+// PrometheusKey returns the key of the prometheus client used to send the query.
+func (c *Connection) PrometheusKey() string {
+	if c.Prometheus != "" {
+		return c.Prometheus
+	}
+	return c.PrometheusURL
+}
+
+// IsPrometheus reports whether the connection is generated from a prometheus query.
+func (c *Connection) IsPrometheus() bool {
+	return c.Type == "" || c.Type == ConnectionTypePrometheus
 }
 
+// QueryLink returns the link to the prometheus graph of the query, the
+// dependency graph of a jaeger connection or the URL of a json connection.
+// Static connections have no link.
 func (c *Connection) QueryLink() string {
-	promURL := strings.TrimSuffix(c.PrometheusURL, "/")
+	switch c.Type {
+	case "", ConnectionTypePrometheus:
+	case ConnectionTypeJaeger:
+		return strings.TrimSuffix(c.URL, "/") + "/dependencies"
+	default:
+		return c.URL
+	}
+	promURL := c.PrometheusURL
+	if c.externalURL != "" {
+		promURL = c.externalURL
+	}
+	promURL = strings.TrimSuffix(promURL, "/")
 	escapedQuery := url.QueryEscape(c.Query)
 
 	return fmt.Sprintf("%s/graph?g0.expr=%s", promURL, escapedQuery)
@@ -88,9 +468,21 @@ type NodeNotice struct {
 	SubTitle          string            `yaml:"subtitle"`
 	Link              string            `yaml:"link"`
 	Query             string            `yaml:"query,omitempty"`
+	Prometheus        string            `yaml:"prometheus,omitempty"`
 	PrometheusURL     string            `yaml:"prometheusURL,omitempty"`
 	SeverityThreshold SeverityThreshold `yaml:"severityThreshold"`
 	Service           *NodeMapping      `yaml:"service,omitempty"`
+	QueryPolicy       `yaml:",inline"`
+
+	externalURL string
+}
+
+// PrometheusKey returns the key of the prometheus client used to send the query.
+func (nn *NodeNotice) PrometheusKey() string {
+	if nn.Prometheus != "" {
+		return nn.Prometheus
+	}
+	return nn.PrometheusURL
 }
 
 func (nn *NodeNotice) QueryLink() string {
@@ -98,11 +490,134 @@ func (nn *NodeNotice) QueryLink() string {
 		return nn.Link
 	}
 
-	promURL := strings.TrimSuffix(nn.PrometheusURL, "/")
+	promURL := nn.PrometheusURL
+	if nn.externalURL != "" {
+		promURL = nn.externalURL
+	}
+	promURL = strings.TrimSuffix(promURL, "/")
 	escapedQuery := url.QueryEscape(nn.Query)
 	return fmt.Sprintf("%s/graph?g0.expr=%s", promURL, escapedQuery)
 }
 
+// NodeMeta attaches metadata, e.g. the owning team or the version, to the
+// nodes the samples of its query are mapped to by Service. The values of
+// Labels of a sample are set as labels of the node and, when Name is set,
+// the value of the sample as the metric Name, combined by Aggregation when
+// several samples are mapped to the same node.
+type NodeMeta struct {
+	Query         string       `yaml:"query"`
+	Prometheus    string       `yaml:"prometheus,omitempty"`
+	PrometheusURL string       `yaml:"prometheusURL,omitempty"`
+	Service       *NodeMapping `yaml:"service,omitempty"`
+	Labels        []string     `yaml:"labels,omitempty"`
+	Name          string       `yaml:"name,omitempty"`
+	Aggregation   string       `yaml:"aggregation,omitempty"`
+	QueryPolicy   `yaml:",inline"`
+
+	externalURL string
+}
+
+// PrometheusKey returns the key of the prometheus client used to send the query.
+func (nm *NodeMeta) PrometheusKey() string {
+	if nm.Prometheus != "" {
+		return nm.Prometheus
+	}
+	return nm.PrometheusURL
+}
+
+var (
+	DefaultAlertSeverityLabel = "severity"
+	DefaultAlertSeverities    = map[string]int{
+		"info":     0,
+		"warning":  1,
+		"error":    2,
+		"critical": 2,
+	}
+)
+
+// AlertNotice turns the firing alerts of a prometheus server, or the active
+// alerts of an alertmanager at AlertmanagerURL, into notices of the node
+// their labels are mapped to by Service, or of the connection mapped to by
+// Source and Target. Only the alerts whose labels equal Matchers are used.
+// Title and SubTitle are templates over the labels and annotations of an
+// alert. The severity of a notice is looked up by the SeverityLabel of the
+// alert in Severities, and is a warning if not found.
+type AlertNotice struct {
+	Prometheus      string            `yaml:"prometheus,omitempty"`
+	PrometheusURL   string            `yaml:"prometheusURL,omitempty"`
+	AlertmanagerURL string            `yaml:"alertmanagerURL,omitempty"`
+	Matchers        map[string]string `yaml:"matchers,omitempty"`
+	Title           string            `yaml:"title,omitempty"`
+	SubTitle        string            `yaml:"subtitle,omitempty"`
+	SeverityLabel   string            `yaml:"severityLabel,omitempty"`
+	Severities      map[string]int    `yaml:"severities,omitempty"`
+	Service         *NodeMapping      `yaml:"service,omitempty"`
+	Source          *NodeMapping      `yaml:"source,omitempty"`
+	Target          *NodeMapping      `yaml:"target,omitempty"`
+	QueryPolicy     `yaml:",inline"`
+
+	externalURL string
+}
+
+// PrometheusKey returns the key of the prometheus client used to get the
+// alerts, or an empty string for an alertmanager.
+func (an *AlertNotice) PrometheusKey() string {
+	if an.Prometheus != "" {
+		return an.Prometheus
+	}
+	return an.PrometheusURL
+}
+
+// AlertLink returns the link to the graph of the ALERTS series of the alert
+// with the given name, used for prometheus alerts, which unlike alertmanager
+// alerts have no generator URL.
+func (an *AlertNotice) AlertLink(alertname string) string {
+	promURL := an.PrometheusURL
+	if an.externalURL != "" {
+		promURL = an.externalURL
+	}
+	promURL = strings.TrimSuffix(promURL, "/")
+	escapedQuery := url.QueryEscape(fmt.Sprintf(`ALERTS{alertname=%q}`, alertname))
+	return fmt.Sprintf("%s/graph?g0.expr=%s", promURL, escapedQuery)
+}
+
+const (
+	OnErrorSkip         OnError = "skip"
+	OnErrorReuseLast    OnError = "reuseLast"
+	OnErrorFailSnapshot OnError = "failSnapshot"
+)
+
+// DefaultOnError is the OnError of the queries without onError, so that a
+// transient failure does not make their connections blink out of the graph.
+const DefaultOnError = OnErrorReuseLast
+
+// OnError is what the generator does when a query still fails after retries:
+// skip drops its result, reuseLast uses the result of the previous snapshot
+// and failSnapshot fails the whole snapshot.
+type OnError string
+
+func (oe *OnError) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	switch v := OnError(s); v {
+	case OnErrorSkip, OnErrorReuseLast, OnErrorFailSnapshot:
+		*oe = v
+		return nil
+	}
+	return fmt.Errorf("Invalid onError %q, must be one of skip, reuseLast or failSnapshot", s)
+}
+
+// QueryPolicy controls how a query is retried and how its failure is handled.
+// A zero Timeout means the query is only bounded by the scrape timeout.
+type QueryPolicy struct {
+	Timeout      prommodel.Duration `yaml:"timeout,omitempty"`
+	Retries      int                `yaml:"retries,omitempty"`
+	RetryBackoff prommodel.Duration `yaml:"retryBackoff,omitempty"`
+	OnError      OnError            `yaml:"onError,omitempty"`
+}
+
 type NodeMapping struct {
 	Label       string `yaml:"label,omitempty"`
 	Regex       Regexp `yaml:"regex,omitempty"`
@@ -116,11 +631,32 @@ type Status struct {
 	DangerRegex  *Regexp `yaml:"dangerRegex,omitempty"`
 }
 
+const (
+	AggregationSum = "sum"
+	AggregationAvg = "avg"
+	AggregationMax = "max"
+	AggregationMin = "min"
+)
+
+// ConnectionMetric is an extra query of a prometheus connection, e.g. the
+// p99 latency, whose samples are joined onto the connections by the source
+// and target mappings of the connection. The samples of a connection are
+// combined by Aggregation, sum by default, and the value is emitted in the
+// metadata of the connection under Name.
+type ConnectionMetric struct {
+	Name        string `yaml:"name"`
+	Query       string `yaml:"query"`
+	Aggregation string `yaml:"aggregation,omitempty"`
+}
+
+// ConnectionNotice is shown on a connection when the ratio of its requests
+// of StatusType, or the value of its Metric, reaches a severity threshold.
 type ConnectionNotice struct {
 	Title             string            `yaml:"title"`
 	SubTitle          string            `yaml:"subtitle"`
 	Link              string            `yaml:"link"`
-	StatusType        string            `yaml:"statusType"`
+	StatusType        string            `yaml:"statusType,omitempty"`
+	Metric            string            `yaml:"metric,omitempty"`
 	SeverityThreshold SeverityThreshold `yaml:"severityThreshold"`
 }
 
@@ -164,6 +700,10 @@ func (re *Regexp) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+func (re Regexp) MarshalYAML() (interface{}, error) {
+	return re.Original, nil
+}
+
 func (nm *NodeMapping) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	*nm = DefaultNodeMapping
 	type plain NodeMapping
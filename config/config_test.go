@@ -1,26 +1,740 @@
 package config
 
 import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"testing"
+	"time"
 
+	promconfig "github.com/prometheus/common/config"
+	prommodel "github.com/prometheus/common/model"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestLoadSimpleConfig(t *testing.T) {
 	path := "testdata/good_simple.yaml"
-	cfg, err := LoadFile(path)
+	cfg, err := LoadFileWithOptions(path, &LoadOptions{AllowUnknownFields: true})
 	require.NoError(t, err)
 	require.NotNil(t, cfg)
 
 	assert.Equal(t, "SimpleDemo", cfg.GraphName)
+
+	// The legacy fields are unknown to strict decoding.
+	_, err = LoadFile(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown field globalLevel.maxVolumeRate")
+
+	cfg, err = LoadFile("testdata/good_simple_strict.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, "SimpleDemo", cfg.GraphName)
 }
 
 func TestLoadFullConfig(t *testing.T) {
 	path := "testdata/good_full.yaml"
-	cfg, err := LoadFile(path)
+	cfg, err := LoadFileWithOptions(path, &LoadOptions{AllowUnknownFields: true})
 	require.NoError(t, err)
 	require.NotNil(t, cfg)
 
 	assert.Equal(t, "Demo", cfg.GraphName)
+
+	_, err = LoadFile(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown field globalLevel.maxVolumeRate")
+
+	cfg, err = LoadFile("testdata/good_full_strict.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, "Demo", cfg.GraphName)
+}
+
+func TestLoadPrometheusServers(t *testing.T) {
+	cfg, err := LoadFile("testdata/good_servers.yaml")
+	require.NoError(t, err)
+	require.Len(t, cfg.PrometheusServers, 2)
+
+	s := cfg.PrometheusServers[0]
+	assert.Equal(t, promconfig.Secret("tenant-1"), s.Headers["X-Scope-OrgID"])
+	assert.Equal(t, "testdata/secrets/password", s.HTTPClientConfig.BasicAuth.PasswordFile)
+	assert.Equal(t, "testdata/secrets/ca.crt", s.HTTPClientConfig.TLSConfig.CAFile)
+	assert.True(t, s.HTTPClientConfig.FollowRedirects)
+
+	conn := cfg.GlobalLevel.Connections[0]
+	assert.Equal(t, "thanos", conn.PrometheusKey())
+	assert.Equal(t, "https://thanos.example.com", conn.PrometheusURL)
+
+	conn = cfg.ClusterLevel[0].Connections[0]
+	assert.Equal(t, "in-cluster", conn.PrometheusKey())
+	assert.Equal(t, "http://prometheus.monitoring.svc:9090", conn.PrometheusURL)
+	assert.Equal(t, "https://prometheus.example.com/graph?g0.expr=status%3Ahttp_requests_total%3Arate2m", conn.QueryLink())
+
+	assert.Equal(t, "thanos", cfg.ClusterLevel[0].Connections[1].PrometheusKey())
+	assert.Equal(t, "http://localhost:9090", cfg.ClusterLevel[0].NodeNotices[0].PrometheusKey())
+
+	content := []byte(`
+clusterLevel:
+  - cluster: demo-cluster-1
+    serviceConnections:
+      - query: up
+        prometheus: unknown
+`)
+	_, err = Load(content, &LoadOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `clusterLevel[0].serviceConnections[0].prometheus: prometheus server "unknown" is not declared`)
+}
+
+func TestLoadExpand(t *testing.T) {
+	path := "testdata/good_expand.yaml"
+	_, err := LoadFile(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 2: environment variable PROMVIZ_TEST_GRAPH_NAME is not defined")
+	// Variables in comments are not expanded.
+	assert.NotContains(t, err.Error(), "PROMVIZ_TEST_UNDEFINED")
+
+	t.Setenv("PROMVIZ_TEST_GRAPH_NAME", "Staging")
+	cfg, err := LoadFile(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, "Staging", cfg.GraphName)
+	assert.Equal(t, "http://localhost:9090", cfg.PrometheusServers[0].URL)
+	assert.Equal(t, promconfig.Secret("tenant-from-file"), cfg.PrometheusServers[0].Headers["X-Scope-OrgID"])
+	assert.Equal(t, "^demo-(.+)$", cfg.ClusterLevel[0].Connections[0].Target.Regex.Original)
+	assert.Equal(t, "$1", cfg.ClusterLevel[0].Connections[0].Target.Replacement)
+}
+
+func TestMarshalRedacted(t *testing.T) {
+	t.Setenv("PROMVIZ_TEST_MAX_VOLUME", "9")
+	t.Setenv("PROMVIZ_TEST_TOKEN", "prom")
+
+	dir := t.TempDir()
+	content := []byte(`clusterLevel:
+  - cluster: team-b
+    serviceConnections:
+      - query: up
+        prometheusURL: http://prom:9090/${PROMVIZ_TEST_TOKEN}
+`)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "team-b.yaml"), content, 0644))
+	content = []byte(`include: ["team-b.yaml"]
+globalLevel:
+  maxVolume: ${PROMVIZ_TEST_MAX_VOLUME}
+clusterLevel:
+  - cluster: team-a
+    serviceConnections:
+      - query: up
+        prometheusURL: http://prom:9090
+`)
+	cfg, err := Load(content, &LoadOptions{Dir: dir})
+	require.NoError(t, err)
+
+	data, err := cfg.MarshalRedacted()
+	require.NoError(t, err)
+	// Only the values written with a variable are redacted, even though
+	// other values contain the same text.
+	assert.Contains(t, string(data), "maxVolume: <secret>")
+	assert.Contains(t, string(data), "prometheusURL: http://prom:9090\n")
+	assert.Contains(t, string(data), "prometheusURL: <secret>\n")
+	assert.NotContains(t, string(data), "9090/prom")
+
+	other, err := Load(content, &LoadOptions{Dir: dir})
+	require.NoError(t, err)
+	assert.False(t, cfg.ChangedSecrets(other))
+	t.Setenv("PROMVIZ_TEST_MAX_VOLUME", "10")
+	other, err = Load(content, &LoadOptions{Dir: dir})
+	require.NoError(t, err)
+	assert.True(t, cfg.ChangedSecrets(other))
+}
+
+func TestLoadExpandMultiLineFile(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "token"), []byte("line1\nline2\n"), 0600))
+	content := []byte(`graphName: $__file{token}
+prometheusServers:
+  - name: prometheus
+    url: http://localhost:9090
+    headers:
+      # A quoted "#" is not a comment: "$__file{token}"
+      Authorization: "Bearer #$__file{token}"
+`)
+	_, _, err := expand(content, dir, true)
+	require.Error(t, err)
+	errs, ok := err.(Errors)
+	require.True(t, ok)
+	require.Len(t, errs, 2)
+	assert.Contains(t, errs[0].Error(), "line 1: file "+filepath.Join(dir, "token")+" must not contain more than one line")
+	assert.Contains(t, errs[1].Error(), "line 7:")
+}
+
+func TestLoadExpandDollar(t *testing.T) {
+	content := []byte(`clusterLevel:
+  - cluster: demo-cluster-1
+    serviceConnections:
+      - query: status:http_requests_total:rate2m
+        prometheusURL: http://localhost:9090
+        source:
+          replacement: INTERNET
+        target:
+          label: service
+          regex: ^demo-(?P<name>.+)$
+          replacement: $${name}
+`)
+	cfg, err := Load(content, &LoadOptions{})
+	require.NoError(t, err)
+	target := cfg.ClusterLevel[0].Connections[0].Target
+	assert.Equal(t, "^demo-(?P<name>.+)$", target.Regex.Original)
+	assert.Equal(t, "${name}", target.Replacement)
+
+	_, err = Load([]byte("graphName: ${name}\n"), &LoadOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 1: environment variable name is not defined (write $${name} for a literal one")
+
+	t.Setenv("PROMVIZ_TEST_GRAPH_NAME", "line1\nline2")
+	_, err = Load([]byte("graphName: ${PROMVIZ_TEST_GRAPH_NAME}\n"), &LoadOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 1: environment variable PROMVIZ_TEST_GRAPH_NAME must not contain more than one line")
+}
+
+func TestLoadInclude(t *testing.T) {
+	cfg, err := LoadFile("testdata/include/promviz.yaml")
+	require.NoError(t, err)
+
+	assert.Equal(t, "Include", cfg.GraphName)
+	require.Len(t, cfg.ClusterLevel, 2)
+	assert.Equal(t, "team-a", cfg.ClusterLevel[0].Cluster)
+	assert.Equal(t, "team-b", cfg.ClusterLevel[1].Cluster)
+	assert.Equal(t, "prometheus", cfg.ClusterLevel[1].Connections[0].PrometheusKey())
+	require.Len(t, cfg.Classes, 1)
+	assert.Equal(t, RendererGlobal, cfg.GlobalLevel.Renderer)
+	require.Len(t, cfg.GlobalLevel.AlertNotices, 1)
+	assert.Equal(t, "Alerts", cfg.GlobalLevel.AlertNotices[0].Title)
+	assert.Equal(t, "prometheus", cfg.GlobalLevel.AlertNotices[0].PrometheusKey())
+
+	errs := cfg.Validate()
+	require.Len(t, errs, 1)
+	verr := errs[0].(*ValidationError)
+	assert.Equal(t, "testdata/include/clusters/team-b.yaml", verr.File)
+	assert.Equal(t, "clusterLevel[0].serviceConnections[0].target.class", verr.Path)
+
+	cfg, err = LoadFile("testdata/include/clusters")
+	require.NoError(t, err)
+	assert.Equal(t, "promviz", cfg.GraphName)
+	assert.Len(t, cfg.ClusterLevel, 2)
+
+	dir := t.TempDir()
+	content := []byte("clusterLevel:\n  - cluster: dup\n")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.yaml"), content, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "b.yaml"), content, 0644))
+	_, err = LoadFile(dir)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `duplicate cluster "dup"`)
+
+	// Duplicates within one included file are reported with the file.
+	dir = t.TempDir()
+	file := filepath.Join(dir, "a.yaml")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`
+clusterLevel:
+  - cluster: dup
+  - cluster: dup
+`), 0644))
+	_, err = LoadFile(dir)
+	require.Error(t, err)
+	assert.Equal(t, fmt.Sprintf(`%s: duplicate cluster "dup" (already declared in %s at clusterLevel[0])`, file, file), err.Error())
+
+	require.NoError(t, ioutil.WriteFile(file, []byte(`
+classes:
+  - name: dup
+    color: red
+  - name: dup
+    color: blue
+`), 0644))
+	_, err = LoadFile(dir)
+	require.Error(t, err)
+	assert.Equal(t, fmt.Sprintf(`%s: duplicate class "dup" (already declared in %s at classes[0])`, file, file), err.Error())
+}
+
+func TestLoadClusterTemplates(t *testing.T) {
+	cfg, err := LoadFile("testdata/good_templates.yaml")
+	require.NoError(t, err)
+	require.Len(t, cfg.ClusterTemplates, 1)
+	assert.Empty(t, cfg.Validate())
+
+	ct := cfg.ClusterTemplates[0]
+	assert.Equal(t, "cluster", ct.Discovery.Label)
+	assert.Equal(t, "prometheus", ct.Discovery.PrometheusKey())
+	assert.Equal(t, 5*time.Minute, time.Duration(ct.RefreshInterval))
+
+	cluster, err := ct.Instantiate("demo-1")
+	require.NoError(t, err)
+	assert.Equal(t, "k8s-demo-1", cluster.Cluster)
+	assert.Equal(t, `status:http_requests_total:rate2m{cluster="demo-1"}`, cluster.Connections[0].Query)
+	assert.Equal(t, "prometheus", cluster.Connections[0].PrometheusKey())
+	assert.Equal(t, "[{{ .value }}] HighErrorRate", cluster.Connections[0].Notices[0].Title)
+	assert.Equal(t, `status:http_requests_total:rate2m{cluster="{{ .cluster }}"}`, ct.Template.Connections[0].Query)
+	assert.Equal(t, `status:http_requests_total:rate2m{cluster="demo-1", namespace="payments"}`, cluster.ChildLevel[0].Connections[0].Query)
+	assert.Equal(t, "prometheus", cluster.ChildLevel[0].Connections[0].PrometheusKey())
+
+	// Values are escaped in queries but not in cluster names.
+	cluster, err = ct.Instantiate(`a"b\c`)
+	require.NoError(t, err)
+	assert.Equal(t, `k8s-a"b\c`, cluster.Cluster)
+	assert.Equal(t, `status:http_requests_total:rate2m{cluster="a\"b\\c"}`, cluster.Connections[0].Query)
+	assert.Empty(t, (&Config{ClusterLevel: []*Cluster{cluster}}).queryErrors())
+}
+
+func TestLoadUnknownField(t *testing.T) {
+	path := "testdata/bad_unknown_field.yaml"
+	_, err := LoadFile(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 5: unknown field clusterLevel[0].serviceConection")
+
+	cfg, err := LoadFileWithOptions(path, &LoadOptions{AllowUnknownFields: true})
+	require.NoError(t, err)
+	assert.Equal(t, "UnknownField", cfg.GraphName)
+}
+
+func TestLoadInvalidQuery(t *testing.T) {
+	cfg, err := LoadFile("testdata/bad_query.yaml")
+	require.Error(t, err)
+
+	errs, ok := err.(Errors)
+	require.True(t, ok)
+	require.Len(t, errs, 1)
+	assert.Equal(t, "clusterLevel[0].serviceConnections[1].query", errs[0].(*ValidationError).Path)
+	assert.Contains(t, errs[0].Error(), `cluster "demo-cluster-1"`)
+
+	// The config is still returned so that the other problems are reported in the same pass.
+	require.NotNil(t, cfg)
+	paths := make([]string, 0)
+	for _, err := range cfg.Validate() {
+		paths = append(paths, err.(*ValidationError).Path)
+	}
+	assert.Equal(t, []string{
+		"clusterLevel[0].serviceConnections[1].target.class",
+		"clusterLevel[0].serviceConnections[1].query",
+	}, paths)
+}
+
+func TestValidate(t *testing.T) {
+	cfg, err := LoadFile("testdata/good_full_strict.yaml")
+	require.NoError(t, err)
+	assert.Empty(t, cfg.Validate())
+
+	cfg, err = LoadFile("testdata/bad_semantic.yaml")
+	require.NoError(t, err)
+
+	paths := make([]string, 0)
+	for _, err := range cfg.Validate() {
+		verr, ok := err.(*ValidationError)
+		require.True(t, ok)
+		paths = append(paths, verr.Path)
+	}
+	assert.Equal(t, []string{
+		"globalLevel.clusterConnections[0]",
+		"clusterLevel[0].serviceConnections[0].target.class",
+		"clusterLevel[0].serviceConnections[0].notices[0].statusType",
+		"clusterLevel[0].serviceConnections[0].notices[0].severityThreshold.error",
+		"clusterLevel[1].cluster",
+	}, paths)
+}
+
+func TestDiff(t *testing.T) {
+	old, err := LoadFile("testdata/good_full_strict.yaml")
+	require.NoError(t, err)
+	new, err := LoadFile("testdata/good_full_strict.yaml")
+	require.NoError(t, err)
+
+	changes, err := Diff(old, new)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+
+	new.GraphName = "Renamed"
+	new.ClusterLevel[0].MaxVolume = 50000
+	new.ClusterLevel = append(new.ClusterLevel[1:], new.ClusterLevel[0])
+	new.Classes = new.Classes[1:]
+
+	changes, err = Diff(old, new)
+	require.NoError(t, err)
+
+	paths := make(map[string]string)
+	for _, c := range changes {
+		paths[c.Path] = c.Kind
+	}
+	assert.Equal(t, map[string]string{
+		"graphName": "changed",
+		"clusterLevel[cluster=demo-cluster-1].maxVolume": "changed",
+		"classes[name=" + old.Classes[0].Name + "]":      "removed",
+	}, paths)
+}
+
+func TestLoadQueryPolicy(t *testing.T) {
+	content := `
+clusterLevel:
+  - cluster: demo
+    serviceConnections:
+      - prometheusURL: http://localhost:9090
+        query: up
+        timeout: 2s
+        retries: 3
+        onError: %s
+        source:
+          replacement: a
+        target:
+          label: job
+`
+	cfg, err := Load([]byte(fmt.Sprintf(content, "reuseLast")), &LoadOptions{})
+	require.NoError(t, err)
+	conn := cfg.ClusterLevel[0].Connections[0]
+	assert.Equal(t, prommodel.Duration(2*time.Second), conn.Timeout)
+	assert.Equal(t, 3, conn.Retries)
+	assert.Equal(t, OnErrorReuseLast, conn.OnError)
+
+	_, err = Load([]byte(fmt.Sprintf(content, "ignore")), &LoadOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `Invalid onError "ignore"`)
+}
+
+func TestLoadReplicas(t *testing.T) {
+	content := `
+prometheusServers:
+  - name: ha
+    replicas:
+      - http://prometheus-0:9090
+      - http://prometheus-1:9090
+    replicaStrategy: %s
+clusterLevel:
+  - cluster: demo
+    serviceConnections:
+      - prometheus: ha
+        query: up
+        source:
+          replacement: a
+        target:
+          label: job
+`
+	cfg, err := Load([]byte(fmt.Sprintf(content, "mostSeries")), &LoadOptions{})
+	require.NoError(t, err)
+	s := cfg.PrometheusServers[0]
+	assert.Equal(t, ReplicaMostSeries, s.ReplicaStrategy)
+	assert.Equal(t, []string{"http://prometheus-0:9090", "http://prometheus-1:9090"}, s.URLs())
+	assert.Equal(t, "http://prometheus-0:9090", cfg.ClusterLevel[0].Connections[0].PrometheusURL)
+
+	_, err = Load([]byte(fmt.Sprintf(content, "random")), &LoadOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `Invalid replicaStrategy "random"`)
+
+	_, err = Load([]byte(`
+prometheusServers:
+  - name: ha
+    url: http://prometheus:9090
+    replicas:
+      - http://prometheus-0:9090
+`), &LoadOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "prometheusServers[0]: url and replicas are mutually exclusive")
+}
+
+func TestLoadConnectionTypes(t *testing.T) {
+	content := []byte(`
+defaultPrometheus: default
+prometheusServers:
+  - name: default
+    url: http://prometheus:9090
+clusterLevel:
+  - cluster: demo
+    serviceConnections:
+      - type: static
+        file: /etc/promviz/edges.yaml
+        source:
+          label: source
+        target:
+          label: target
+      - type: json
+        url: http://dependencies/api/edges
+        query: not promql(
+        source:
+          label: source
+        target:
+          label: target
+      - type: static
+        prometheus: default
+        source:
+          label: source
+        target:
+          label: target
+`)
+	cfg, err := Load(content, &LoadOptions{})
+	require.NoError(t, err)
+	conns := cfg.ClusterLevel[0].Connections
+	assert.Empty(t, conns[0].PrometheusKey())
+	assert.False(t, conns[1].IsPrometheus())
+	assert.Equal(t, "http://dependencies/api/edges", conns[1].QueryLink())
+
+	paths := make([]string, 0)
+	for _, err := range cfg.Validate() {
+		paths = append(paths, err.Error())
+	}
+	assert.Equal(t, []string{
+		"clusterLevel[0].serviceConnections[2]: file is required by static connections",
+		"clusterLevel[0].serviceConnections[2]: prometheus and prometheusURL are only used by prometheus connections",
+	}, paths)
+}
+
+func TestLoadAlertNotices(t *testing.T) {
+	content := []byte(`
+defaultPrometheus: default
+prometheusServers:
+  - name: default
+    url: http://prometheus:9090
+    externalURL: https://prometheus.example.com
+clusterLevel:
+  - cluster: demo
+    alertNotices:
+      - service:
+          label: service
+        matchers:
+          team: core
+      - alertmanagerURL: http://alertmanager:9093
+        source:
+          label: source
+        target:
+          label: target
+      - alertmanagerURL: http://alertmanager:9093
+        prometheus: default
+`)
+	cfg, err := Load(content, &LoadOptions{})
+	require.NoError(t, err)
+	notices := cfg.ClusterLevel[0].AlertNotices
+	assert.Equal(t, "default", notices[0].PrometheusKey())
+	assert.Equal(t, "https://prometheus.example.com/graph?g0.expr=ALERTS%7Balertname%3D%22Down%22%7D", notices[0].AlertLink("Down"))
+	assert.Empty(t, notices[1].PrometheusKey())
+
+	paths := make([]string, 0)
+	for _, err := range cfg.Validate() {
+		paths = append(paths, err.Error())
+	}
+	assert.Equal(t, []string{
+		"clusterLevel[0].alertNotices[2]: alertmanagerURL and prometheus are mutually exclusive",
+		"clusterLevel[0].alertNotices[2]: service or source and target is required",
+	}, paths)
+}
+
+func TestValidateConnectionType(t *testing.T) {
+	content := []byte(`
+clusterLevel:
+  - cluster: demo
+    serviceConnections:
+      - type: statc
+        file: edges.json
+        source:
+          label: source
+        target:
+          label: target
+      - type: custom-config-test
+        source:
+          label: source
+        target:
+          label: target
+`)
+	cfg, err := Load(content, &LoadOptions{})
+	require.NoError(t, err)
+
+	errs := make([]string, 0)
+	for _, err := range cfg.Validate() {
+		errs = append(errs, err.Error())
+	}
+	assert.Equal(t, []string{
+		`clusterLevel[0].serviceConnections[0].type: unknown connection type "statc"`,
+		`clusterLevel[0].serviceConnections[1].type: unknown connection type "custom-config-test"`,
+	}, errs)
+
+	// Types of registered data sources are accepted.
+	RegisterConnectionType("custom-config-test")
+	errs = errs[:0]
+	for _, err := range cfg.Validate() {
+		errs = append(errs, err.Error())
+	}
+	assert.Equal(t, []string{
+		`clusterLevel[0].serviceConnections[0].type: unknown connection type "statc"`,
+	}, errs)
+}
+
+func TestValidateConnectionMetrics(t *testing.T) {
+	content := []byte(`
+clusterLevel:
+  - cluster: demo
+    serviceConnections:
+      - prometheusURL: http://prometheus:9090
+        query: sum(rate(requests_total[1m])) by (source, target)
+        source:
+          label: source
+        target:
+          label: target
+        metrics:
+          - name: p99
+            query: histogram_quantile(0.99, sum(rate(latency_bucket[1m])) by (le, source, target))
+            aggregation: max
+          - name: p99
+            query: up
+            aggregation: median
+        notices:
+          - title: Slow
+            metric: p99
+            severityThreshold:
+              warning: 0.5
+          - title: Unknown
+            metric: bytes
+`)
+	cfg, err := Load(content, &LoadOptions{})
+	require.NoError(t, err)
+
+	paths := make([]string, 0)
+	for _, err := range cfg.Validate() {
+		paths = append(paths, err.Error())
+	}
+	assert.Equal(t, []string{
+		`clusterLevel[0].serviceConnections[0].metrics[1].name: duplicate metric name "p99"`,
+		`clusterLevel[0].serviceConnections[0].metrics[1].aggregation: aggregation must be one of sum, avg, max or min, got "median"`,
+		`clusterLevel[0].serviceConnections[0].notices[1].metric: metric "bytes" is not declared in metrics`,
+	}, paths)
+
+	_, err = Load([]byte(`
+clusterLevel:
+  - cluster: demo
+    serviceConnections:
+      - prometheusURL: http://prometheus:9090
+        query: up
+        metrics:
+          - name: p99
+            query: rate(
+`), &LoadOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "clusterLevel[0].serviceConnections[0].metrics[0].query")
+}
+
+func TestLoadServiceMetadata(t *testing.T) {
+	content := []byte(`
+defaultPrometheus: default
+prometheusServers:
+  - name: default
+    url: http://prometheus:9090
+clusterLevel:
+  - cluster: demo
+    serviceMetadata:
+      - query: max(kube_deployment_labels) by (service, label_team, label_version)
+        service:
+          label: service
+        labels: [label_team, label_version]
+      - query: sum(kube_deployment_status_replicas) by (service)
+        prometheusURL: http://other:9090
+        service:
+          label: service
+        name: replicas
+        aggregation: median
+      - query: up
+        service:
+          label: service
+`)
+	cfg, err := Load(content, &LoadOptions{})
+	require.NoError(t, err)
+	metadata := cfg.ClusterLevel[0].NodeMetadata
+	require.Len(t, metadata, 3)
+	assert.Equal(t, "default", metadata[0].PrometheusKey())
+	assert.Equal(t, "http://other:9090", metadata[1].PrometheusKey())
+
+	paths := make([]string, 0)
+	for _, err := range cfg.Validate() {
+		paths = append(paths, err.Error())
+	}
+	assert.Equal(t, []string{
+		`clusterLevel[0].serviceMetadata[1].aggregation: aggregation must be one of sum, avg, max or min, got "median"`,
+		"clusterLevel[0].serviceMetadata[2]: labels or name is required",
+	}, paths)
+}
+
+func TestLoadChildLevels(t *testing.T) {
+	content := []byte(`
+prometheusServers:
+  - name: global
+    url: http://global:9090
+  - name: eu
+    url: http://eu:9090
+defaultPrometheus: global
+clusterLevel:
+  - cluster: eu
+    defaultPrometheus: eu
+    serviceConnections:
+      - query: cluster_requests
+        source:
+          label: source
+        target:
+          label: target
+    childLevel:
+      - cluster: cluster-1
+        renderer: focused
+        childLevel:
+          - cluster: payments
+            serviceConnections:
+              - query: service_requests
+                source:
+                  label: source
+                target:
+                  label: target
+          - cluster: payments
+            renderer: global
+`)
+	cfg, err := Load(content, &LoadOptions{})
+	require.NoError(t, err)
+	namespace := cfg.ClusterLevel[0].ChildLevel[0].ChildLevel[0]
+	assert.Equal(t, "eu", namespace.Connections[0].PrometheusKey())
+
+	paths := make([]string, 0)
+	for _, err := range cfg.Validate() {
+		paths = append(paths, err.Error())
+	}
+	assert.Equal(t, []string{
+		`clusterLevel[0].childLevel[0].childLevel[1].cluster: duplicate cluster name "payments" (already declared at clusterLevel[0].childLevel[0].childLevel[0])`,
+		`clusterLevel[0].childLevel[0].childLevel[1].renderer: renderer must be one of region, focused, focusedChild or dns, got "global"`,
+	}, paths)
+
+	old, err := Load(content, &LoadOptions{})
+	require.NoError(t, err)
+	cfg.ClusterLevel[0].ChildLevel[0].MaxVolume = 100
+	changes, err := Diff(old, cfg)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, "clusterLevel[cluster=eu].childLevel[cluster=cluster-1].maxVolume", changes[0].Path)
+}
+
+func TestLoadGroups(t *testing.T) {
+	content := []byte(`
+clusterLevel:
+  - cluster: demo
+    groups:
+      - regex: ^redis-.*$
+        replacement: redis
+        class: cache
+      - label: namespace
+        drillDown: true
+      - replacement: other
+      - regex: ^(.*)-api$
+        replacement: ""
+classes:
+  - name: cache
+    color: rgb(0, 0, 255)
+`)
+	cfg, err := Load(content, &LoadOptions{})
+	require.NoError(t, err)
+	groups := cfg.ClusterLevel[0].Groups
+	require.Len(t, groups, 4)
+	assert.Equal(t, "$1", groups[1].Replacement)
+	assert.Equal(t, "^(.+)$", groups[1].Regex.Original)
+	assert.True(t, groups[1].DrillDown)
+
+	paths := make([]string, 0)
+	for _, err := range cfg.Validate() {
+		paths = append(paths, err.Error())
+	}
+	assert.Equal(t, []string{
+		"clusterLevel[0].groups[2]: label or regex is required",
+		"clusterLevel[0].groups[3].replacement: replacement must not be empty",
+	}, paths)
 }
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/nghialv/promviz/model"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// keyFields are the top-level lists whose items are matched by name instead of index.
+var keyFields = map[string]string{
+	"clusterLevel":      "cluster",
+	"prometheusServers": "name",
+	"classes":           "name",
+}
+
+// Diff returns the structural changes from old to new. Clusters, including
+// those of child levels, classes and prometheus servers are matched by name,
+// so reordering them is not a change.
+// Other lists are compared item by item.
+func Diff(old, new *Config) ([]*model.ConfigChange, error) {
+	a, err := toTree(old)
+	if err != nil {
+		return nil, err
+	}
+	b, err := toTree(new)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]*model.ConfigChange, 0)
+	diffValue("", a, b, &changes)
+	return changes, nil
+}
+
+func toTree(cfg *Config) (interface{}, error) {
+	if cfg == nil {
+		return map[string]interface{}{}, nil
+	}
+	data, err := cfg.MarshalRedacted()
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := yamlv3.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func diffValue(path string, a, b interface{}, changes *[]*model.ConfigChange) {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		if bv, ok := b.(map[string]interface{}); ok {
+			diffMap(path, av, bv, changes)
+			return
+		}
+	case []interface{}:
+		if bv, ok := b.([]interface{}); ok {
+			diffList(path, av, bv, changes)
+			return
+		}
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		*changes = append(*changes, &model.ConfigChange{
+			Kind: "changed",
+			Path: path,
+			Old:  a,
+			New:  b,
+		})
+	}
+}
+
+func diffMap(path string, a, b map[string]interface{}, changes *[]*model.ConfigChange) {
+	diffEntries(a, b, changes, func(k string) string {
+		if path == "" {
+			return k
+		}
+		return path + "." + k
+	})
+}
+
+func diffEntries(a, b map[string]interface{}, changes *[]*model.ConfigChange, pathOf func(string) string) {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		kpath := pathOf(k)
+		av, aok := a[k]
+		bv, bok := b[k]
+		switch {
+		case !aok:
+			*changes = append(*changes, &model.ConfigChange{Kind: "added", Path: kpath})
+		case !bok:
+			*changes = append(*changes, &model.ConfigChange{Kind: "removed", Path: kpath})
+		default:
+			diffValue(kpath, av, bv, changes)
+		}
+	}
+}
+
+func diffList(path string, a, b []interface{}, changes *[]*model.ConfigChange) {
+	field, ok := keyFields[path]
+	if strings.HasSuffix(path, ".childLevel") {
+		field, ok = "cluster", true
+	}
+	if ok {
+		am, aok := indexByKey(a, field)
+		bm, bok := indexByKey(b, field)
+		if aok && bok {
+			diffEntries(am, bm, changes, func(k string) string {
+				return fmt.Sprintf("%s[%s]", path, k)
+			})
+			return
+		}
+	}
+
+	for i := 0; i < len(a) || i < len(b); i++ {
+		ipath := fmt.Sprintf("%s[%d]", path, i)
+		switch {
+		case i >= len(a):
+			*changes = append(*changes, &model.ConfigChange{Kind: "added", Path: ipath})
+		case i >= len(b):
+			*changes = append(*changes, &model.ConfigChange{Kind: "removed", Path: ipath})
+		default:
+			diffValue(ipath, a[i], b[i], changes)
+		}
+	}
+}
+
+// indexByKey returns the items keyed by "field=value", or false if any item
+// does not have a unique value of the field.
+func indexByKey(items []interface{}, field string) (map[string]interface{}, bool) {
+	m := make(map[string]interface{}, len(items))
+	for _, item := range items {
+		im, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		v, ok := im[field].(string)
+		if !ok {
+			return nil, false
+		}
+		key := fmt.Sprintf("%s=%s", field, v)
+		if _, ok := m[key]; ok {
+			return nil, false
+		}
+		m[key] = item
+	}
+	return m, true
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var expandRegexp = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}|\$__file\{([^}]+)\}`)
+
+// expand replaces ${ENV_VAR} and ${ENV_VAR:-default} with the value of the
+// environment variable and $__file{path} with the content of the file.
+// Relative file paths are joined with dir. "$$" is an escaped "$", e.g. for
+// the named groups of replacements, and other "$" are left as they are.
+// Comments are left as they are. Undefined variables, unreadable files and
+// variables or files of more than one line, which would break the YAML
+// structure and the line numbers of errors, are reported as errors.
+// The lines where variables or files were substituted are returned as well.
+// When enabled is false, references to variables and files are reported as
+// errors and only "$$" is replaced.
+func expand(content []byte, dir string, enabled bool) ([]byte, []int, error) {
+	var (
+		errs     Errors
+		expanded []int
+	)
+	lines := bytes.Split(content, []byte("\n"))
+
+	for i, line := range lines {
+		text, comment := splitComment(line)
+		out := expandRegexp.ReplaceAllFunc(text, func(m []byte) []byte {
+			sub := expandRegexp.FindSubmatch(m)
+			switch {
+			case string(m) == "$$":
+				return []byte("$")
+
+			case !enabled:
+				errs = append(errs, fmt.Errorf("line %d: expansion of %s is disabled", i+1, m))
+				return m
+
+			case len(sub[4]) > 0:
+				path := string(sub[4])
+				if dir != "" && !filepath.IsAbs(path) {
+					path = filepath.Join(dir, path)
+				}
+				data, err := ioutil.ReadFile(path)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("line %d: %v", i+1, err))
+					return m
+				}
+				data = bytes.TrimRight(data, "\r\n")
+				if bytes.ContainsAny(data, "\r\n") {
+					errs = append(errs, fmt.Errorf("line %d: file %s must not contain more than one line", i+1, path))
+					return m
+				}
+				expanded = append(expanded, i+1)
+				return data
+
+			default:
+				name := string(sub[1])
+				if value, ok := os.LookupEnv(name); ok {
+					if strings.ContainsAny(value, "\r\n") {
+						errs = append(errs, fmt.Errorf("line %d: environment variable %s must not contain more than one line", i+1, name))
+						return m
+					}
+					expanded = append(expanded, i+1)
+					return []byte(value)
+				}
+				if len(sub[2]) > 0 {
+					return sub[3]
+				}
+				errs = append(errs, fmt.Errorf("line %d: environment variable %s is not defined (write $%s for a literal one, e.g. a named group)", i+1, name, m))
+				return m
+			}
+		})
+		lines[i] = append(out, comment...)
+	}
+
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+	return bytes.Join(lines, []byte("\n")), expanded, nil
+}
+
+// splitComment splits line before the "#" starting a YAML comment, which is
+// at the start of the line or after a space and outside of quoted strings.
+func splitComment(line []byte) ([]byte, []byte) {
+	var quote byte
+	for i, c := range line {
+		startOfToken := i == 0 || bytes.IndexByte([]byte(" \t[{,"), line[i-1]) >= 0
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && startOfToken:
+			quote = c
+		case c == '#' && startOfToken:
+			return line[:i], line[i:]
+		}
+	}
+	return line, nil
+}
@@ -0,0 +1,213 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type origin struct {
+	file string
+	path string
+}
+
+// include loads every file matched by the include patterns and merges it
+// into c. Relative patterns are joined with dir, and the file placed at self
+// is never included again. When restricted, only files in dir can be
+// included and the errors of included files omit their content, so that
+// other files can not be read through untrusted content.
+func (c *Config) include(dir, self string, restricted bool, opts *LoadOptions) error {
+	seen := map[string]struct{}{
+		filepath.Clean(self): {},
+	}
+
+	for _, pattern := range c.Include {
+		if dir != "" && !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		if restricted && !withinDir(dir, pattern) {
+			return fmt.Errorf("Include pattern %q must be in %s", pattern, dir)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid include pattern %q: %v", pattern, err)
+		}
+
+		for _, file := range files {
+			if _, ok := seen[file]; ok {
+				continue
+			}
+			seen[file] = struct{}{}
+
+			fi, err := os.Stat(file)
+			if err != nil {
+				return err
+			}
+			if fi.IsDir() {
+				continue
+			}
+
+			if restricted {
+				realDir, _ := filepath.EvalSymlinks(dir)
+				if real, err := filepath.EvalSymlinks(file); err != nil || !withinDir(realDir, real) {
+					return fmt.Errorf("%s: included file must be in %s", file, dir)
+				}
+			}
+			part, err := decodeFile(file, opts)
+			if err != nil && restricted {
+				return fmt.Errorf("%s: invalid config", file)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %v", file, err)
+			}
+			if len(part.Include) > 0 {
+				return fmt.Errorf("%s: nested include is not supported", file)
+			}
+			if err := c.merge(part, file); err != nil {
+				return fmt.Errorf("%s: %v", file, err)
+			}
+		}
+	}
+	return nil
+}
+
+// merge appends the clusters, cluster templates, classes, prometheus servers,
+// global connections and global alert notices of part declared in file to c.
+func (c *Config) merge(part *Config, file string) error {
+	if c.origins == nil {
+		c.origins = make(map[string]origin)
+	}
+	c.mergeExpanded(part, map[string]int{
+		"clusterLevel":                   len(c.ClusterLevel),
+		"clusterTemplates":               len(c.ClusterTemplates),
+		"classes":                        len(c.Classes),
+		"prometheusServers":              len(c.PrometheusServers),
+		"globalLevel.clusterConnections": len(c.GlobalLevel.Connections),
+		"globalLevel.alertNotices":       len(c.GlobalLevel.AlertNotices),
+	})
+
+	mergeString := func(key string, dst *string, src string) error {
+		if src == "" {
+			return nil
+		}
+		if *dst != "" && *dst != src {
+			return fmt.Errorf("%s is already set to %q", key, *dst)
+		}
+		*dst = src
+		return nil
+	}
+	if err := mergeString("graphName", &c.GraphName, part.GraphName); err != nil {
+		return err
+	}
+	if err := mergeString("defaultPrometheus", &c.DefaultPrometheus, part.DefaultPrometheus); err != nil {
+		return err
+	}
+	if err := mergeString("globalLevel.renderer", &c.GlobalLevel.Renderer, part.GlobalLevel.Renderer); err != nil {
+		return err
+	}
+	if part.GlobalLevel.MaxVolume != 0 {
+		if c.GlobalLevel.MaxVolume != 0 && c.GlobalLevel.MaxVolume != part.GlobalLevel.MaxVolume {
+			return fmt.Errorf("globalLevel.maxVolume is already set to %s", formatFloat(c.GlobalLevel.MaxVolume))
+		}
+		c.GlobalLevel.MaxVolume = part.GlobalLevel.MaxVolume
+	}
+
+	clusters := make(map[string]int, len(c.ClusterLevel))
+	for i, cluster := range c.ClusterLevel {
+		clusters[cluster.Cluster] = i
+	}
+	for i, cluster := range part.ClusterLevel {
+		if j, ok := clusters[cluster.Cluster]; ok {
+			return fmt.Errorf("duplicate cluster %q (already declared in %s)",
+				cluster.Cluster, c.describe(fmt.Sprintf("clusterLevel[%d]", j)))
+		}
+		clusters[cluster.Cluster] = len(c.ClusterLevel)
+		c.addOrigin("clusterLevel", len(c.ClusterLevel), file, i)
+		c.ClusterLevel = append(c.ClusterLevel, cluster)
+	}
+
+	classes := make(map[string]int, len(c.Classes))
+	for i, class := range c.Classes {
+		classes[class.Name] = i
+	}
+	for i, class := range part.Classes {
+		if j, ok := classes[class.Name]; ok {
+			return fmt.Errorf("duplicate class %q (already declared in %s)",
+				class.Name, c.describe(fmt.Sprintf("classes[%d]", j)))
+		}
+		classes[class.Name] = len(c.Classes)
+		c.addOrigin("classes", len(c.Classes), file, i)
+		c.Classes = append(c.Classes, class)
+	}
+
+	for i, ct := range part.ClusterTemplates {
+		c.addOrigin("clusterTemplates", len(c.ClusterTemplates), file, i)
+		c.ClusterTemplates = append(c.ClusterTemplates, ct)
+	}
+	for i, s := range part.PrometheusServers {
+		c.addOrigin("prometheusServers", len(c.PrometheusServers), file, i)
+		c.PrometheusServers = append(c.PrometheusServers, s)
+	}
+	for i, conn := range part.GlobalLevel.Connections {
+		c.addOrigin("globalLevel.clusterConnections", len(c.GlobalLevel.Connections), file, i)
+		c.GlobalLevel.Connections = append(c.GlobalLevel.Connections, conn)
+	}
+	for i, an := range part.GlobalLevel.AlertNotices {
+		c.addOrigin("globalLevel.alertNotices", len(c.GlobalLevel.AlertNotices), file, i)
+		c.GlobalLevel.AlertNotices = append(c.GlobalLevel.AlertNotices, an)
+	}
+	return nil
+}
+
+// withinDir reports whether path is dir or a path under it.
+func withinDir(dir, path string) bool {
+	if dir == "" {
+		dir = "."
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (c *Config) addOrigin(key string, index int, file string, fileIndex int) {
+	c.origins[fmt.Sprintf("%s[%d]", key, index)] = origin{
+		file: file,
+		path: fmt.Sprintf("%s[%d]", key, fileIndex),
+	}
+}
+
+// describe returns the file and the path in that file of the given element.
+func (c *Config) describe(path string) string {
+	if o, ok := c.origins[path]; ok {
+		return fmt.Sprintf("%s at %s", o.file, o.path)
+	}
+	return path
+}
+
+// locate rewrites the paths of validation errors in err to be relative to
+// the included file declaring the offending element.
+func (c *Config) locate(err error) error {
+	errs, ok := err.(Errors)
+	if !ok || len(c.origins) == 0 {
+		return err
+	}
+	for _, e := range errs {
+		c.locateError(e)
+	}
+	return errs
+}
+
+func (c *Config) locateError(err error) {
+	verr, ok := err.(*ValidationError)
+	if !ok || verr.File != "" {
+		return
+	}
+	for key, o := range c.origins {
+		if verr.Path != key && !strings.HasPrefix(verr.Path, key+".") {
+			continue
+		}
+		verr.File = o.file
+		verr.Path = o.path + strings.TrimPrefix(verr.Path, key)
+		return
+	}
+}
@@ -0,0 +1,168 @@
+package config
+
+import (
+	"fmt"
+)
+
+// resolvePrometheusServers validates the declared prometheus servers, applies
+// the graph and cluster level defaultPrometheus to prometheus connections,
+// notices, alert notices and service metadata without any prometheus or
+// alertmanager, and
+// fills the prometheusURL of every one referring to a server with its url or
+// its first replica.
+func (c *Config) resolvePrometheusServers() error {
+	var errs Errors
+	addf := func(path, format string, args ...interface{}) {
+		errs = append(errs, &ValidationError{
+			Path:    path,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	servers := make(map[string]*PrometheusServer, len(c.PrometheusServers))
+	// urlPaths are the paths of the urls of the servers, so that the url
+	// copied into a connection is redacted like the url of its server.
+	urlPaths := make(map[string]string, len(c.PrometheusServers))
+	for i, s := range c.PrometheusServers {
+		path := fmt.Sprintf("prometheusServers[%d]", i)
+		if s.Name == "" {
+			addf(path+".name", "prometheus server name must not be empty")
+			continue
+		}
+		if _, ok := servers[s.Name]; ok {
+			addf(path+".name", "duplicate prometheus server name %q", s.Name)
+			continue
+		}
+		switch {
+		case s.URL == "" && len(s.Replicas) == 0:
+			addf(path+".url", "url or replicas is required")
+		case s.URL != "" && len(s.Replicas) > 0:
+			addf(path, "url and replicas are mutually exclusive")
+		}
+		for j, r := range s.Replicas {
+			if r == "" {
+				addf(fmt.Sprintf("%s.replicas[%d]", path, j), "replica url must not be empty")
+			}
+		}
+		if s.ReplicaStrategy != "" && len(s.Replicas) == 0 {
+			addf(path+".replicaStrategy", "replicaStrategy has no effect without replicas")
+		}
+		if s.MaxConcurrentQueries < 0 {
+			addf(path+".maxConcurrentQueries", "maxConcurrentQueries must not be negative")
+		}
+		if s.QueryRateLimit < 0 {
+			addf(path+".queryRateLimit", "queryRateLimit must not be negative")
+		}
+		if err := s.HTTPClientConfig.Validate(); err != nil {
+			addf(path, "%v", err)
+		}
+		servers[s.Name] = s
+		urlPaths[s.Name] = path + ".url"
+		if s.URL == "" {
+			urlPaths[s.Name] = path + ".replicas[0]"
+		}
+	}
+
+	checkDefault := func(path, name string) {
+		if name == "" {
+			return
+		}
+		if _, ok := servers[name]; !ok {
+			addf(path, "prometheus server %q is not declared in prometheusServers", name)
+		}
+	}
+
+	resolve := func(path, def string, name, url, externalURL *string) {
+		if *name == "" && *url == "" {
+			*name = def
+		}
+		if *name == "" {
+			return
+		}
+		s, ok := servers[*name]
+		if !ok {
+			if *name != def {
+				addf(path+".prometheus", "prometheus server %q is not declared in prometheusServers", *name)
+			}
+			return
+		}
+		if *url != "" {
+			addf(path, "prometheus and prometheusURL are mutually exclusive")
+			return
+		}
+		*url = s.URLs()[0]
+		*externalURL = s.ExternalURL
+		if _, ok := c.expanded[urlPaths[*name]]; ok {
+			c.addExpanded(path + ".prometheusURL")
+		}
+	}
+
+	checkDefault("defaultPrometheus", c.DefaultPrometheus)
+	resolveAlerts := func(path, def string, notices []*AlertNotice) {
+		for j, an := range notices {
+			if an.AlertmanagerURL != "" {
+				continue
+			}
+			resolve(fmt.Sprintf("%s.alertNotices[%d]", path, j), def,
+				&an.Prometheus, &an.PrometheusURL, &an.externalURL)
+		}
+	}
+
+	resolveAlerts("globalLevel", c.DefaultPrometheus, c.GlobalLevel.AlertNotices)
+	for i, conn := range c.GlobalLevel.Connections {
+		if !conn.IsPrometheus() {
+			continue
+		}
+		resolve(fmt.Sprintf("globalLevel.clusterConnections[%d]", i), c.DefaultPrometheus,
+			&conn.Prometheus, &conn.PrometheusURL, &conn.externalURL)
+	}
+	var resolveCluster func(path, parentDef string, cluster *Cluster)
+	resolveCluster = func(path, parentDef string, cluster *Cluster) {
+		def := cluster.DefaultPrometheus
+		if def == "" {
+			def = parentDef
+		} else {
+			checkDefault(path+".defaultPrometheus", def)
+		}
+		for j, conn := range cluster.Connections {
+			if !conn.IsPrometheus() {
+				continue
+			}
+			resolve(fmt.Sprintf("%s.serviceConnections[%d]", path, j), def,
+				&conn.Prometheus, &conn.PrometheusURL, &conn.externalURL)
+		}
+		for j, noti := range cluster.NodeNotices {
+			resolve(fmt.Sprintf("%s.serviceNotices[%d]", path, j), def,
+				&noti.Prometheus, &noti.PrometheusURL, &noti.externalURL)
+		}
+		resolveAlerts(path, def, cluster.AlertNotices)
+		for j, meta := range cluster.NodeMetadata {
+			resolve(fmt.Sprintf("%s.serviceMetadata[%d]", path, j), def,
+				&meta.Prometheus, &meta.PrometheusURL, &meta.externalURL)
+		}
+		// Child levels inherit the defaultPrometheus of their parent.
+		for j, child := range cluster.ChildLevel {
+			resolveCluster(fmt.Sprintf("%s.childLevel[%d]", path, j), def, child)
+		}
+	}
+	for i, cluster := range c.ClusterLevel {
+		resolveCluster(fmt.Sprintf("clusterLevel[%d]", i), c.DefaultPrometheus, cluster)
+	}
+
+	for i, ct := range c.ClusterTemplates {
+		path := fmt.Sprintf("clusterTemplates[%d]", i)
+		var externalURL string
+		resolve(path+".discovery", c.DefaultPrometheus,
+			&ct.Discovery.Prometheus, &ct.Discovery.PrometheusURL, &externalURL)
+		if ct.Template == nil {
+			addf(path, "template is required")
+			continue
+		}
+		resolveCluster(path+".template", c.DefaultPrometheus, ct.Template)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
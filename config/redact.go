@@ -0,0 +1,135 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// redacted replaces the secrets of a config when it is shown, like the
+// secrets of promconfig.
+const redacted = "<secret>"
+
+// markExpanded records the paths of the scalar values of content placed on
+// the given lines, which are the lines where variables or files were
+// substituted.
+func (c *Config) markExpanded(content []byte, lines []int) {
+	if len(lines) == 0 {
+		return
+	}
+	root := parseYAMLNode(content)
+	if root == nil {
+		return
+	}
+	set := make(map[int]struct{}, len(lines))
+	for _, l := range lines {
+		set[l] = struct{}{}
+	}
+	walkScalars(root, "", func(path string, node *yamlv3.Node) {
+		first, last := node.Line, node.Line
+		if node.Style&(yamlv3.LiteralStyle|yamlv3.FoldedStyle) != 0 {
+			last += strings.Count(node.Value, "\n") + 1
+		}
+		for l := first; l <= last; l++ {
+			if _, ok := set[l]; ok {
+				c.addExpanded(path)
+				return
+			}
+		}
+	})
+}
+
+func (c *Config) addExpanded(paths ...string) {
+	for _, p := range paths {
+		if c.expanded == nil {
+			c.expanded = make(map[string]struct{})
+		}
+		c.expanded[p] = struct{}{}
+	}
+}
+
+// mergeExpanded records the expanded paths of part, whose elements of the
+// list at key were appended to c from the given offset.
+func (c *Config) mergeExpanded(part *Config, offsets map[string]int) {
+	for p := range part.expanded {
+		for key, offset := range offsets {
+			var idx int
+			if !strings.HasPrefix(p, key+"[") {
+				continue
+			}
+			if _, err := fmt.Sscanf(p[len(key):], "[%d]", &idx); err == nil {
+				p = fmt.Sprintf("%s[%d]%s", key, offset+idx, p[strings.Index(p, "]")+1:])
+			}
+			break
+		}
+		c.addExpanded(p)
+	}
+}
+
+// MarshalRedacted returns the config as YAML without its secrets, so that it
+// can be shown or stored. Headers and the secrets of the HTTP client configs
+// are redacted, and so is every value that was written with an environment
+// variable or a file substituted while loading.
+func (c *Config) MarshalRedacted() ([]byte, error) {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.expanded) == 0 {
+		return data, nil
+	}
+
+	var root yamlv3.Node
+	if err := yamlv3.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	if len(root.Content) > 0 {
+		walkScalars(root.Content[0], "", func(path string, node *yamlv3.Node) {
+			if _, ok := c.expanded[path]; ok {
+				node.Value, node.Tag, node.Style = redacted, "!!str", 0
+			}
+		})
+	}
+	return yamlv3.Marshal(&root)
+}
+
+// walkScalars calls fn with the path of every scalar value under node.
+// Keys of mappings are skipped so that the structure stays readable.
+func walkScalars(node *yamlv3.Node, path string, fn func(string, *yamlv3.Node)) {
+	switch node.Kind {
+	case yamlv3.ScalarNode:
+		fn(path, node)
+	case yamlv3.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			if path != "" {
+				key = path + "." + key
+			}
+			walkScalars(node.Content[i+1], key, fn)
+		}
+	case yamlv3.SequenceNode:
+		for i, n := range node.Content {
+			walkScalars(n, fmt.Sprintf("%s[%d]", path, i), fn)
+		}
+	}
+}
+
+// ChangedSecrets reports whether a redacted value of c differs in other,
+// which is not visible in their redacted forms.
+func (c *Config) ChangedSecrets(other *Config) bool {
+	if c == nil || other == nil {
+		return false
+	}
+	a, err := yaml.Marshal(c)
+	if err != nil {
+		return true
+	}
+	b, err := yaml.Marshal(other)
+	if err != nil {
+		return true
+	}
+	return !bytes.Equal(a, b)
+}
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"bytes"
+	"strconv"
+	"text/template"
+	"time"
+
+	prommodel "github.com/prometheus/common/model"
+)
+
+var DefaultClusterTemplate = ClusterTemplate{
+	Discovery: ClusterDiscovery{
+		Label: "cluster",
+	},
+	RefreshInterval: prommodel.Duration(time.Minute),
+}
+
+// ClusterTemplate generates a cluster for each value of a label returned by
+// the discovery query. The cluster name and the queries of the template can
+// refer to the value by the label name, e.g. {{ .cluster }}. In queries, the
+// value is escaped to be used inside a quoted PromQL string.
+type ClusterTemplate struct {
+	Discovery       ClusterDiscovery   `yaml:"discovery"`
+	RefreshInterval prommodel.Duration `yaml:"refreshInterval,omitempty"`
+	Template        *Cluster           `yaml:"template"`
+}
+
+type ClusterDiscovery struct {
+	Query         string `yaml:"query"`
+	Label         string `yaml:"label,omitempty"`
+	Prometheus    string `yaml:"prometheus,omitempty"`
+	PrometheusURL string `yaml:"prometheusURL,omitempty"`
+}
+
+// PrometheusKey returns the key of the prometheus client used to send the query.
+func (cd *ClusterDiscovery) PrometheusKey() string {
+	if cd.Prometheus != "" {
+		return cd.Prometheus
+	}
+	return cd.PrometheusURL
+}
+
+func (ct *ClusterTemplate) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*ct = DefaultClusterTemplate
+	type plain ClusterTemplate
+	return unmarshal((*plain)(ct))
+}
+
+// Instantiate generates the cluster for the given label value.
+// Only the cluster names and the queries are rendered, so notice titles can
+// still refer to {{ .value }} when the graph is generated.
+func (ct *ClusterTemplate) Instantiate(value string) (*Cluster, error) {
+	data := map[string]string{
+		ct.Discovery.Label: value,
+	}
+	cluster, err := instantiateCluster(ct.Template, data)
+	if err != nil {
+		return nil, err
+	}
+	if ct.Template.Cluster == "" {
+		cluster.Cluster = value
+	}
+	return cluster, nil
+}
+
+func instantiateCluster(tmpl *Cluster, data map[string]string) (*Cluster, error) {
+	cluster := *tmpl
+	name, err := renderTemplate(tmpl.Cluster, data)
+	if err != nil {
+		return nil, err
+	}
+	cluster.Cluster = name
+
+	cluster.Connections = make([]*Connection, 0, len(tmpl.Connections))
+	for _, c := range tmpl.Connections {
+		conn := *c
+		query, err := renderQuery(c.Query, data)
+		if err != nil {
+			return nil, err
+		}
+		conn.Query = query
+		conn.Metrics = make([]*ConnectionMetric, 0, len(c.Metrics))
+		for _, m := range c.Metrics {
+			metric := *m
+			if metric.Query, err = renderQuery(m.Query, data); err != nil {
+				return nil, err
+			}
+			conn.Metrics = append(conn.Metrics, &metric)
+		}
+		cluster.Connections = append(cluster.Connections, &conn)
+	}
+
+	cluster.NodeNotices = make([]*NodeNotice, 0, len(tmpl.NodeNotices))
+	for _, n := range tmpl.NodeNotices {
+		noti := *n
+		query, err := renderQuery(n.Query, data)
+		if err != nil {
+			return nil, err
+		}
+		noti.Query = query
+		cluster.NodeNotices = append(cluster.NodeNotices, &noti)
+	}
+
+	cluster.NodeMetadata = make([]*NodeMeta, 0, len(tmpl.NodeMetadata))
+	for _, m := range tmpl.NodeMetadata {
+		meta := *m
+		query, err := renderQuery(m.Query, data)
+		if err != nil {
+			return nil, err
+		}
+		meta.Query = query
+		cluster.NodeMetadata = append(cluster.NodeMetadata, &meta)
+	}
+
+	cluster.ChildLevel = make([]*Cluster, 0, len(tmpl.ChildLevel))
+	for _, c := range tmpl.ChildLevel {
+		child, err := instantiateCluster(c, data)
+		if err != nil {
+			return nil, err
+		}
+		cluster.ChildLevel = append(cluster.ChildLevel, child)
+	}
+
+	return &cluster, nil
+}
+
+// renderQuery renders a query with the values escaped as the content of a
+// PromQL string, so a value containing " or \ can not change the query when
+// it is used in a label matcher, e.g. {cluster="{{ .cluster }}"}.
+func renderQuery(text string, data map[string]string) (string, error) {
+	escaped := make(map[string]string, len(data))
+	for k, v := range data {
+		q := strconv.Quote(v)
+		escaped[k] = q[1 : len(q)-1]
+	}
+	return renderTemplate(text, escaped)
+}
+
+func renderTemplate(text string, data map[string]string) (string, error) {
+	t, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
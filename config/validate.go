@@ -0,0 +1,414 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// ValidationError is a semantic problem found in a loaded configuration.
+// Path is the YAML path of the offending element, e.g. "clusterLevel[0].serviceConnections[1].query".
+// File is set when the element was declared in an included file.
+type ValidationError struct {
+	File    string
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("%s: %s: %s", e.File, e.Path, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// Errors is a list of problems reported as a single error.
+type Errors []error
+
+func (es Errors) Error() string {
+	msgs := make([]string, 0, len(es))
+	for _, e := range es {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// ValidateQueries parses every query of the configuration with the PromQL parser.
+func (c *Config) ValidateQueries() error {
+	errs := c.queryErrors()
+	if len(errs) == 0 {
+		return nil
+	}
+	return Errors(errs)
+}
+
+func (c *Config) queryErrors() []error {
+	var errs []error
+	check := func(path, scope, query string) {
+		if query == "" {
+			return
+		}
+		if _, err := parser.ParseExpr(query); err != nil {
+			errs = append(errs, &ValidationError{
+				Path:    path + ".query",
+				Message: fmt.Sprintf("invalid query of %s: %v", scope, err),
+			})
+		}
+	}
+
+	checkConn := func(path, scope string, conn *Connection) {
+		// Only prometheus connections have a PromQL query.
+		if conn.IsPrometheus() {
+			check(path, scope, conn.Query)
+			for i, m := range conn.Metrics {
+				check(fmt.Sprintf("%s.metrics[%d]", path, i), scope, m.Query)
+			}
+		}
+	}
+
+	for i, conn := range c.GlobalLevel.Connections {
+		checkConn(fmt.Sprintf("globalLevel.clusterConnections[%d]", i), "global level", conn)
+	}
+	checkCluster := func(path, scope string, cluster *Cluster) {
+		if scope == "" {
+			scope = fmt.Sprintf("cluster %q", cluster.Cluster)
+		}
+		for j, conn := range cluster.Connections {
+			checkConn(fmt.Sprintf("%s.serviceConnections[%d]", path, j), scope, conn)
+		}
+		for j, noti := range cluster.NodeNotices {
+			check(fmt.Sprintf("%s.serviceNotices[%d]", path, j), scope, noti.Query)
+		}
+		for j, meta := range cluster.NodeMetadata {
+			check(fmt.Sprintf("%s.serviceMetadata[%d]", path, j), scope, meta.Query)
+		}
+	}
+	for i, cluster := range c.ClusterLevel {
+		cluster.Walk(fmt.Sprintf("clusterLevel[%d]", i), func(path string, cluster *Cluster) {
+			checkCluster(path, "", cluster)
+		})
+	}
+
+	for i, ct := range c.ClusterTemplates {
+		path := fmt.Sprintf("clusterTemplates[%d]", i)
+		check(path+".discovery", "cluster template discovery", ct.Discovery.Query)
+		if ct.Template == nil {
+			continue
+		}
+		// Queries are checked against a cluster instantiated with a placeholder value.
+		cluster, err := ct.Instantiate("placeholder")
+		if err != nil {
+			errs = append(errs, &ValidationError{
+				Path:    path + ".template",
+				Message: fmt.Sprintf("invalid template: %v", err),
+			})
+			continue
+		}
+		cluster.Walk(path+".template", func(path string, cluster *Cluster) {
+			checkCluster(path, "cluster template", cluster)
+		})
+	}
+	return errs
+}
+
+// Validate runs semantic checks that can not be expressed by the YAML schema
+// and returns every problem found.
+func (c *Config) Validate() []error {
+	v := &validator{
+		classes: make(map[string]struct{}, len(c.Classes)+1),
+	}
+	v.classes[DefaultClass.Name] = struct{}{}
+
+	for i, class := range c.Classes {
+		path := fmt.Sprintf("classes[%d]", i)
+		if class.Name == "" {
+			v.addf(path+".name", "class name must not be empty")
+			continue
+		}
+		v.classes[class.Name] = struct{}{}
+	}
+
+	switch c.GlobalLevel.Renderer {
+	case "", RendererGlobal, RendererRegion:
+	default:
+		v.addf("globalLevel.renderer", "renderer must be one of global or region, got %q", c.GlobalLevel.Renderer)
+	}
+	for i, conn := range c.GlobalLevel.Connections {
+		v.validateConnection(fmt.Sprintf("globalLevel.clusterConnections[%d]", i), conn)
+	}
+	for i, an := range c.GlobalLevel.AlertNotices {
+		v.validateAlertNotice(fmt.Sprintf("globalLevel.alertNotices[%d]", i), an)
+	}
+
+	v.validateLevel("clusterLevel", c.ClusterLevel)
+
+	for i, ct := range c.ClusterTemplates {
+		path := fmt.Sprintf("clusterTemplates[%d]", i)
+		if ct.Discovery.Query == "" {
+			v.addf(path+".discovery", "query is required")
+		}
+		if ct.Discovery.Label == "" {
+			v.addf(path+".discovery", "label is required")
+		}
+		if ct.Discovery.PrometheusKey() == "" {
+			v.addf(path+".discovery", "prometheus or prometheusURL is required")
+		}
+		if ct.Template == nil {
+			v.addf(path, "template is required")
+			continue
+		}
+		v.validateCluster(path+".template", ct.Template)
+	}
+
+	errs := append(v.errs, c.queryErrors()...)
+	for _, err := range errs {
+		c.locateError(err)
+	}
+	return errs
+}
+
+type validator struct {
+	classes map[string]struct{}
+	errs    []error
+}
+
+// validateLevel validates the clusters of a level, whose names must be
+// unique as they are the names of the nodes they are generated inside.
+func (v *validator) validateLevel(path string, clusters []*Cluster) {
+	names := make(map[string]string, len(clusters))
+	for i, cluster := range clusters {
+		cpath := fmt.Sprintf("%s[%d]", path, i)
+		switch prev, ok := names[cluster.Cluster]; {
+		case cluster.Cluster == "":
+			v.addf(cpath+".cluster", "cluster name must not be empty")
+		case ok:
+			v.addf(cpath+".cluster", "duplicate cluster name %q (already declared at %s)", cluster.Cluster, prev)
+		default:
+			names[cluster.Cluster] = cpath
+		}
+		v.validateCluster(cpath, cluster)
+	}
+}
+
+func (v *validator) validateCluster(path string, cluster *Cluster) {
+	switch cluster.Renderer {
+	case "", RendererRegion, RendererFocused, RendererFocusedChild, RendererDNS:
+	default:
+		v.addf(path+".renderer", "renderer must be one of region, focused, focusedChild or dns, got %q", cluster.Renderer)
+	}
+	for j, conn := range cluster.Connections {
+		v.validateConnection(fmt.Sprintf("%s.serviceConnections[%d]", path, j), conn)
+	}
+	for j, noti := range cluster.NodeNotices {
+		v.validateNodeNotice(fmt.Sprintf("%s.serviceNotices[%d]", path, j), noti)
+	}
+	for j, an := range cluster.AlertNotices {
+		v.validateAlertNotice(fmt.Sprintf("%s.alertNotices[%d]", path, j), an)
+	}
+	for j, meta := range cluster.NodeMetadata {
+		v.validateNodeMeta(fmt.Sprintf("%s.serviceMetadata[%d]", path, j), meta)
+	}
+	for j, group := range cluster.Groups {
+		v.validateNodeGroup(fmt.Sprintf("%s.groups[%d]", path, j), group)
+	}
+	v.validateLevel(path+".childLevel", cluster.ChildLevel)
+}
+
+func (v *validator) validateNodeGroup(path string, group *NodeGroup) {
+	if group.Label == "" && group.Regex.Original == DefaultNodeGroup.Regex.Original {
+		v.addf(path, "label or regex is required")
+	}
+	if group.Replacement == "" {
+		v.addf(path+".replacement", "replacement must not be empty")
+	}
+	if group.Class == "" {
+		return
+	}
+	if _, ok := v.classes[group.Class]; !ok {
+		v.addf(path+".class", "class %q is not declared in classes", group.Class)
+	}
+}
+
+func (v *validator) addf(path, format string, args ...interface{}) {
+	v.errs = append(v.errs, &ValidationError{
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) validateConnection(path string, conn *Connection) {
+	switch conn.Type {
+	case "", ConnectionTypePrometheus:
+		if conn.Query == "" {
+			v.addf(path, "query is required")
+		}
+		if conn.PrometheusKey() == "" {
+			v.addf(path, "prometheus or prometheusURL is required")
+		}
+	case ConnectionTypeStatic:
+		if conn.File == "" {
+			v.addf(path, "file is required by static connections")
+		}
+	case ConnectionTypeJSON, ConnectionTypeJaeger:
+		if conn.URL == "" {
+			v.addf(path, "url is required by %s connections", conn.Type)
+		}
+	default:
+		if !isConnectionType(conn.Type) {
+			v.addf(path+".type", "unknown connection type %q", conn.Type)
+		}
+	}
+	if conn.Lookback != 0 && conn.Type != ConnectionTypeJaeger {
+		v.addf(path+".lookback", "lookback is only used by jaeger connections")
+	}
+	if !conn.IsPrometheus() && conn.PrometheusKey() != "" {
+		v.addf(path, "prometheus and prometheusURL are only used by prometheus connections")
+	}
+	v.validateNodeMapping(path, "source", conn.Source)
+	v.validateNodeMapping(path, "target", conn.Target)
+	v.validateQueryPolicy(path, conn.QueryPolicy)
+
+	metrics := make(map[string]struct{}, len(conn.Metrics))
+	if len(conn.Metrics) > 0 && !conn.IsPrometheus() {
+		v.addf(path+".metrics", "metrics are only supported by prometheus connections")
+	}
+	for i, m := range conn.Metrics {
+		mpath := fmt.Sprintf("%s.metrics[%d]", path, i)
+		if m.Name == "" {
+			v.addf(mpath+".name", "metric name must not be empty")
+		} else if _, ok := metrics[m.Name]; ok {
+			v.addf(mpath+".name", "duplicate metric name %q", m.Name)
+		}
+		metrics[m.Name] = struct{}{}
+		if m.Query == "" {
+			v.addf(mpath, "query is required")
+		}
+		switch m.Aggregation {
+		case "", AggregationSum, AggregationAvg, AggregationMax, AggregationMin:
+		default:
+			v.addf(mpath+".aggregation", "aggregation must be one of sum, avg, max or min, got %q", m.Aggregation)
+		}
+	}
+
+	for i, noti := range conn.Notices {
+		npath := fmt.Sprintf("%s.notices[%d]", path, i)
+		if noti.Metric != "" {
+			if noti.StatusType != "" {
+				v.addf(npath, "statusType and metric are mutually exclusive")
+			}
+			if _, ok := metrics[noti.Metric]; !ok {
+				v.addf(npath+".metric", "metric %q is not declared in metrics", noti.Metric)
+			}
+		} else {
+			switch noti.StatusType {
+			case "danger", "warning":
+			default:
+				v.addf(npath+".statusType", "statusType must be one of danger or warning, got %q", noti.StatusType)
+			}
+		}
+		v.validateSeverityThreshold(npath+".severityThreshold", noti.SeverityThreshold)
+	}
+}
+
+func (v *validator) validateNodeNotice(path string, noti *NodeNotice) {
+	if noti.Query == "" {
+		v.addf(path, "query is required")
+	}
+	if noti.PrometheusKey() == "" {
+		v.addf(path, "prometheus or prometheusURL is required")
+	}
+	v.validateNodeMapping(path, "service", noti.Service)
+	v.validateQueryPolicy(path, noti.QueryPolicy)
+	v.validateSeverityThreshold(path+".severityThreshold", noti.SeverityThreshold)
+}
+
+func (v *validator) validateAlertNotice(path string, an *AlertNotice) {
+	switch {
+	case an.AlertmanagerURL == "" && an.PrometheusKey() == "":
+		v.addf(path, "prometheus, prometheusURL or alertmanagerURL is required")
+	case an.AlertmanagerURL != "" && an.PrometheusKey() != "":
+		v.addf(path, "alertmanagerURL and prometheus are mutually exclusive")
+	}
+	switch {
+	case an.Service != nil && (an.Source != nil || an.Target != nil):
+		v.addf(path, "service and source/target are mutually exclusive")
+	case an.Service != nil:
+		v.validateNodeMapping(path, "service", an.Service)
+	case an.Source != nil || an.Target != nil:
+		v.validateNodeMapping(path, "source", an.Source)
+		v.validateNodeMapping(path, "target", an.Target)
+	default:
+		v.addf(path, "service or source and target is required")
+	}
+	v.validateQueryPolicy(path, an.QueryPolicy)
+}
+
+func (v *validator) validateNodeMeta(path string, meta *NodeMeta) {
+	if meta.Query == "" {
+		v.addf(path, "query is required")
+	}
+	if meta.PrometheusKey() == "" {
+		v.addf(path, "prometheus or prometheusURL is required")
+	}
+	if len(meta.Labels) == 0 && meta.Name == "" {
+		v.addf(path, "labels or name is required")
+	}
+	switch meta.Aggregation {
+	case "", AggregationSum, AggregationAvg, AggregationMax, AggregationMin:
+	default:
+		v.addf(path+".aggregation", "aggregation must be one of sum, avg, max or min, got %q", meta.Aggregation)
+	}
+	v.validateNodeMapping(path, "service", meta.Service)
+	v.validateQueryPolicy(path, meta.QueryPolicy)
+}
+
+func (v *validator) validateNodeMapping(path, key string, nm *NodeMapping) {
+	if nm == nil {
+		v.addf(path, "%s is required", key)
+		return
+	}
+	if nm.Class == "" {
+		return
+	}
+	if _, ok := v.classes[nm.Class]; !ok {
+		v.addf(path+"."+key+".class", "class %q is not declared in classes", nm.Class)
+	}
+}
+
+func (v *validator) validateQueryPolicy(path string, qp QueryPolicy) {
+	if qp.Retries < 0 {
+		v.addf(path+".retries", "retries must not be negative")
+	}
+	if qp.Retries == 0 && qp.RetryBackoff != 0 {
+		v.addf(path+".retryBackoff", "retryBackoff has no effect without retries")
+	}
+}
+
+func (v *validator) validateSeverityThreshold(path string, st SeverityThreshold) {
+	levels := []struct {
+		name  string
+		value float64
+	}{
+		{"info", st.Info},
+		{"warning", st.Warning},
+		{"error", st.Error},
+	}
+
+	prev := -1
+	for i, l := range levels {
+		if l.value <= 0 {
+			continue
+		}
+		if prev >= 0 && l.value <= levels[prev].value {
+			v.addf(path+"."+l.name, "%s threshold (%s) must be greater than %s threshold (%s)",
+				l.name, formatFloat(l.value), levels[prev].name, formatFloat(levels[prev].value))
+		}
+		prev = i
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
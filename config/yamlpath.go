@@ -0,0 +1,102 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+var pathSegmentRegexp = regexp.MustCompile(`^([^\[]+)(?:\[(\d+)\])?$`)
+
+// LineOf returns the line of the deepest YAML node in content that matches
+// the given path such as "clusterLevel[0].serviceConnections[1].query".
+// Zero is returned if content could not be parsed.
+func LineOf(content []byte, path string) int {
+	root := parseYAMLNode(content)
+	if root == nil {
+		return 0
+	}
+	node, line := root, root.Line
+
+	for _, seg := range strings.Split(path, ".") {
+		m := pathSegmentRegexp.FindStringSubmatch(seg)
+		if m == nil {
+			return line
+		}
+
+		value := mappingValue(node, m[1])
+		if value == nil {
+			return line
+		}
+		node, line = value, value.Line
+
+		if m[2] == "" {
+			continue
+		}
+		idx, _ := strconv.Atoi(m[2])
+		if node.Kind != yaml.SequenceNode || idx >= len(node.Content) {
+			return line
+		}
+		node, line = node.Content[idx], node.Content[idx].Line
+	}
+	return line
+}
+
+// pathOf returns the path of the mapping key placed at the given line.
+// An empty string is returned if no such key exists.
+func pathOf(content []byte, line int, key string) string {
+	root := parseYAMLNode(content)
+	if root == nil {
+		return ""
+	}
+	return findKeyPath(root, "", line, key)
+}
+
+func findKeyPath(node *yaml.Node, path string, line int, key string) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			k, v := node.Content[i], node.Content[i+1]
+			kpath := k.Value
+			if path != "" {
+				kpath = path + "." + k.Value
+			}
+			if k.Line == line && k.Value == key {
+				return kpath
+			}
+			if p := findKeyPath(v, kpath, line, key); p != "" {
+				return p
+			}
+		}
+	case yaml.SequenceNode:
+		for i, n := range node.Content {
+			if p := findKeyPath(n, fmt.Sprintf("%s[%d]", path, i), line, key); p != "" {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+func parseYAMLNode(content []byte) *yaml.Node {
+	var root yaml.Node
+	if err := yaml.Unmarshal(content, &root); err != nil || len(root.Content) == 0 {
+		return nil
+	}
+	return root.Content[0]
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const yamlPathContent = `graphName: Demo
+clusterLevel:
+  - cluster: demo-cluster-1
+    serviceConnections:
+      - query: up
+        target:
+          class: http
+      - query: errors
+        target:
+          label: service
+          class: grpc
+  - cluster: demo-cluster-2
+    serviceConnections: []
+`
+
+func TestLineOf(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		line int
+	}{
+		{"top-level key", "graphName", 1},
+		{"sequence", "clusterLevel", 3},
+		{"sequence item", "clusterLevel[1]", 12},
+		{"nested sequence item", "clusterLevel[0].serviceConnections[1]", 8},
+		{"key in nested sequence", "clusterLevel[0].serviceConnections[1].target.class", 11},
+		{"missing key", "clusterLevel[0].serviceConnections[1].target.regex", 10},
+		{"index out of range", "clusterLevel[0].serviceConnections[2].query", 5},
+		{"index of empty sequence", "clusterLevel[1].serviceConnections[0]", 13},
+		{"index of a mapping", "clusterLevel[0].serviceConnections[0].target[0]", 7},
+		{"invalid segment", "clusterLevel[0].[1]", 3},
+		{"missing top-level key", "classes[0].name", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.line, LineOf([]byte(yamlPathContent), tt.path))
+		})
+	}
+
+	assert.Equal(t, 0, LineOf([]byte("graphName: [\n"), "graphName"))
+	assert.Equal(t, 0, LineOf(nil, "graphName"))
+}
+
+func TestPathOf(t *testing.T) {
+	tests := []struct {
+		name string
+		line int
+		key  string
+		path string
+	}{
+		{"top-level key", 1, "graphName", "graphName"},
+		{"key in sequence item", 3, "cluster", "clusterLevel[0].cluster"},
+		{"key in nested sequence", 11, "class", "clusterLevel[0].serviceConnections[1].target.class"},
+		{"second sequence item", 13, "serviceConnections", "clusterLevel[1].serviceConnections"},
+		{"other key on the line", 11, "label", ""},
+		{"line without key", 14, "graphName", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.path, pathOf([]byte(yamlPathContent), tt.line, tt.key))
+		})
+	}
+
+	assert.Equal(t, "", pathOf([]byte("graphName: [\n"), 1, "graphName"))
+}
@@ -0,0 +1,22 @@
+package model
+
+import (
+	"time"
+)
+
+// ConfigRecord is an applied configuration kept in the config history.
+type ConfigRecord struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Hash      string          `json:"hash"`
+	Config    string          `json:"config"`
+	Changes   []*ConfigChange `json:"changes"`
+}
+
+// ConfigChange is a structural change from the previously applied configuration.
+// Kind is one of added, removed or changed.
+type ConfigChange struct {
+	Kind string      `json:"kind"`
+	Path string      `json:"path"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
@@ -5,6 +5,17 @@ import (
 )
 
 type Snapshot struct {
-	Timestamp time.Time `json:"timestamp"`
-	GraphJSON string    `json:"graphJSON"`
+	Timestamp     time.Time      `json:"timestamp"`
+	GraphJSON     string         `json:"graphJSON"`
+	FailedQueries []*FailedQuery `json:"failedQueries,omitempty"`
+}
+
+// FailedQuery is a query which still failed after its retries while the
+// snapshot was generated. OnError is how the failure was handled.
+type FailedQuery struct {
+	Cluster    string `json:"cluster,omitempty"`
+	Prometheus string `json:"prometheus"`
+	Query      string `json:"query"`
+	Error      string `json:"error"`
+	OnError    string `json:"onError"`
 }
@@ -0,0 +1,33 @@
+package model
+
+import (
+	"time"
+)
+
+// QueryStatus is the result of the latest run of a configured query.
+// Query identifies the query in its cluster, e.g. "serviceConnections[0]".
+// LastRun is the wall-clock time the query was sent. Skipped queries were not
+// sent for the latest snapshot, e.g. the queries of a cluster template which
+// has not discovered any cluster.
+type QueryStatus struct {
+	Cluster         string    `json:"cluster,omitempty"`
+	Query           string    `json:"query"`
+	Expr            string    `json:"expr"`
+	Prometheus      string    `json:"prometheus"`
+	LastRun         time.Time `json:"lastRun"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	Error           string    `json:"error,omitempty"`
+	Series          int       `json:"series"`
+	DroppedSamples  int       `json:"droppedSamples"`
+	Skipped         bool      `json:"skipped,omitempty"`
+}
+
+// ReplicaStatus is the health of one replica of a prometheus server according
+// to the latest query sent to it. A replica not queried yet is healthy.
+type ReplicaStatus struct {
+	Prometheus string    `json:"prometheus"`
+	URL        string    `json:"url"`
+	Healthy    bool      `json:"healthy"`
+	LastCheck  time.Time `json:"lastCheck"`
+	LastError  string    `json:"lastError,omitempty"`
+}
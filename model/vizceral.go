@@ -21,6 +21,8 @@ type Node struct {
 	Nodes       []*Node       `json:"nodes,omitempty"`
 	Connections []*Connection `json:"connections"`
 	Notices     []*Notice     `json:"notices"`
+	// Stale is set when the node is fed by a query result reused after a failure.
+	Stale bool `json:"stale,omitempty"`
 	// Props
 }
 
@@ -31,10 +33,17 @@ type Connection struct {
 	Metadata *Metadata `json:"metadata"`
 	Metrics  *Metrics  `json:"metrics"`
 	Notices  []*Notice `json:"notices"`
+	// Stale is set when the connection is generated from a query result reused after a failure.
+	Stale bool `json:"stale,omitempty"`
 }
 
 type Metadata struct {
 	Streaming int `json:"streaming"`
+	// Metrics are the values of the extra metrics of a connection, or of
+	// the service metadata of a node, by name.
+	Metrics map[string]float64 `json:"metrics,omitempty"`
+	// Labels are the labels of the service metadata of a node.
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 type Notice struct {
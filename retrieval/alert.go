@@ -0,0 +1,250 @@
+package retrieval
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nghialv/promviz/config"
+	"github.com/nghialv/promviz/model"
+	prometheus "github.com/prometheus/client_golang/api/prometheus/v1"
+	prommodel "github.com/prometheus/common/model"
+	"go.uber.org/zap"
+)
+
+const (
+	// Alerts are turned into samples so that their labels are mapped to nodes
+	// like query results. The annotations and the generator URL of an alert
+	// are kept in labels with these reserved names.
+	alertAnnotationPrefix   = "__annotation_"
+	alertGeneratorURLLabel  = "__generator_url__"
+	defaultAlertTitle       = "{{.alertname}}"
+	defaultAlertSubTitle    = "{{.summary}}"
+	defaultAlertSeverity    = 1
+	alertmanagerAlertsPath  = "/api/v2/alerts"
+	alertmanagerAlertsQuery = "active=true&silenced=false&inhibited=false"
+)
+
+var alertmanagerClient = &http.Client{}
+
+// alertmanagerAlert is an entry of the response of /api/v2/alerts.
+type alertmanagerAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	GeneratorURL string            `json:"generatorURL"`
+}
+
+// alertSourceKey identifies where the alerts of an alert notice come from.
+func alertSourceKey(an *config.AlertNotice) string {
+	if an.AlertmanagerURL != "" {
+		return "alertmanager:" + an.AlertmanagerURL
+	}
+	return an.PrometheusKey()
+}
+
+// alertExpr describes the alerts used by an alert notice in the query status.
+func alertExpr(an *config.AlertNotice) string {
+	matchers := make([]string, 0, len(an.Matchers))
+	for k, v := range an.Matchers {
+		matchers = append(matchers, fmt.Sprintf("%s=%q", k, v))
+	}
+	sort.Strings(matchers)
+	return fmt.Sprintf("ALERTS{%s}", strings.Join(matchers, ","))
+}
+
+// fetchAlerts returns a sample for every firing alert of the alert notice
+// whose labels match its matchers.
+func (g *generator) fetchAlerts(ctx context.Context, an *config.AlertNotice, ts time.Time) (prommodel.Value, error) {
+	vector := make(prommodel.Vector, 0)
+	add := func(labels, annotations map[string]string, generatorURL string) {
+		for k, v := range an.Matchers {
+			if labels[k] != v {
+				return
+			}
+		}
+		metric := make(prommodel.Metric, len(labels)+len(annotations)+1)
+		for k, v := range labels {
+			metric[prommodel.LabelName(k)] = prommodel.LabelValue(v)
+		}
+		for k, v := range annotations {
+			metric[prommodel.LabelName(alertAnnotationPrefix+k)] = prommodel.LabelValue(v)
+		}
+		metric[alertGeneratorURLLabel] = prommodel.LabelValue(generatorURL)
+		vector = append(vector, &prommodel.Sample{
+			Metric:    metric,
+			Value:     1,
+			Timestamp: prommodel.TimeFromUnixNano(ts.UnixNano()),
+		})
+	}
+
+	if an.AlertmanagerURL == "" {
+		alerts, err := g.querier.Alerts(ctx, an.PrometheusKey())
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range alerts {
+			if a.State != prometheus.AlertStateFiring {
+				continue
+			}
+			add(labelSetToMap(a.Labels), labelSetToMap(a.Annotations), "")
+		}
+		return vector, nil
+	}
+
+	alerts, err := getAlertmanagerAlerts(ctx, an.AlertmanagerURL)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range alerts {
+		add(a.Labels, a.Annotations, a.GeneratorURL)
+	}
+	return vector, nil
+}
+
+func labelSetToMap(ls prommodel.LabelSet) map[string]string {
+	m := make(map[string]string, len(ls))
+	for k, v := range ls {
+		m[string(k)] = string(v)
+	}
+	return m
+}
+
+// getAlertmanagerAlerts returns the active alerts of the alertmanager which
+// are neither silenced nor inhibited.
+func getAlertmanagerAlerts(ctx context.Context, addr string) ([]*alertmanagerAlert, error) {
+	u, err := url.Parse(strings.TrimSuffix(addr, "/") + alertmanagerAlertsPath)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = alertmanagerAlertsQuery
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := alertmanagerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("Unexpected status %s from %s", resp.Status, addr)
+	}
+	var alerts []*alertmanagerAlert
+	if err := json.NewDecoder(resp.Body).Decode(&alerts); err != nil {
+		return nil, fmt.Errorf("Failed to decode alerts from %s: %v", addr, err)
+	}
+	return alerts, nil
+}
+
+// generateAlertNotices returns the notices generated from the alert samples
+// by node, or by connection key when the alert notice maps source and target,
+// and the number of alerts dropped because they could not be mapped.
+func (g *generator) generateAlertNotices(vector prommodel.Vector, an *config.AlertNotice) (map[string][]*model.Notice, int) {
+	title, err := template.New("title").Parse(orDefault(an.Title, defaultAlertTitle))
+	if err != nil {
+		g.logger.Warn("Failed to parse alert notice title", zap.Error(err))
+		return nil, len(vector)
+	}
+	subtitle, err := template.New("subtitle").Parse(orDefault(an.SubTitle, defaultAlertSubTitle))
+	if err != nil {
+		g.logger.Warn("Failed to parse alert notice subtitle", zap.Error(err))
+		return nil, len(vector)
+	}
+	severityLabel := orDefault(an.SeverityLabel, config.DefaultAlertSeverityLabel)
+	severities := an.Severities
+	if severities == nil {
+		severities = config.DefaultAlertSeverities
+	}
+
+	notices := make(map[string][]*model.Notice)
+	dropped := 0
+	for _, s := range vector {
+		logger := g.logger.With(zap.Any("sample", s))
+
+		var key string
+		if an.Service != nil {
+			node, err := extractNodeName(s, an.Service)
+			if err != nil {
+				dropped++
+				logger.Debug("Could not determine node of alert", zap.Error(err))
+				continue
+			}
+			key = node
+		} else {
+			source, err := extractNodeName(s, an.Source)
+			if err != nil {
+				dropped++
+				logger.Debug("Could not determine source node of alert", zap.Error(err))
+				continue
+			}
+			target, err := extractNodeName(s, an.Target)
+			if err != nil {
+				dropped++
+				logger.Debug("Could not determine target node of alert", zap.Error(err))
+				continue
+			}
+			key = connectionKey(source, target)
+		}
+
+		// Labels take precedence over annotations of the same name.
+		data := make(map[string]string, len(s.Metric))
+		for k, v := range s.Metric {
+			if name := string(k); strings.HasPrefix(name, alertAnnotationPrefix) {
+				data[strings.TrimPrefix(name, alertAnnotationPrefix)] = string(v)
+			}
+		}
+		for k, v := range s.Metric {
+			if name := string(k); !strings.HasPrefix(name, "__") {
+				data[name] = string(v)
+			}
+		}
+
+		var tbuf, sbuf bytes.Buffer
+		if err := title.Execute(&tbuf, data); err != nil {
+			logger.Error("Failed to execute rendering alert notice title", zap.Error(err))
+			continue
+		}
+		if err := subtitle.Execute(&sbuf, data); err != nil {
+			logger.Error("Failed to execute rendering alert notice subtitle", zap.Error(err))
+			continue
+		}
+
+		severity, ok := severities[data[severityLabel]]
+		if !ok {
+			severity = defaultAlertSeverity
+		}
+		link := string(s.Metric[alertGeneratorURLLabel])
+		if link == "" && an.AlertmanagerURL == "" {
+			link = an.AlertLink(data["alertname"])
+		}
+
+		notices[key] = append(notices[key], &model.Notice{
+			Title:    tbuf.String(),
+			Subtitle: sbuf.String(),
+			Link:     link,
+			Severity: severity,
+		})
+	}
+	return notices, dropped
+}
+
+func connectionKey(source, target string) string {
+	return source + "/" + target
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
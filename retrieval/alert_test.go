@@ -0,0 +1,186 @@
+package retrieval
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nghialv/promviz/config"
+	"github.com/nghialv/promviz/model"
+	prometheus "github.com/prometheus/client_golang/api/prometheus/v1"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestAlertNotices(t *testing.T) {
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query = req.URL.RawQuery
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{
+			"labels": {"alertname": "HighLatency", "service": "b", "severity": "critical"},
+			"annotations": {"summary": "p99 is 3s"},
+			"generatorURL": "http://prometheus/graph?g0.expr=latency"
+		}]`))
+	}))
+	defer srv.Close()
+
+	nodeMapping := func(label string) *config.NodeMapping {
+		return &config.NodeMapping{Label: label, Regex: config.MustNewRegexp("(.*)"), Replacement: "$1"}
+	}
+	alerts := []*config.AlertNotice{
+		{
+			PrometheusURL: "http://prometheus",
+			Matchers:      map[string]string{"team": "core"},
+			Service:       nodeMapping("service"),
+		},
+		{
+			PrometheusURL: "http://prometheus",
+			Title:         "{{.alertname}} to {{.target}}",
+			Source:        nodeMapping("source"),
+			Target:        nodeMapping("target"),
+		},
+		{
+			AlertmanagerURL: srv.URL,
+			Service:         nodeMapping("service"),
+		},
+	}
+	q := &fakeQuerier{
+		values: map[string]prommodel.Value{
+			"up": newTestVector("a", "b"),
+		},
+		alerts: []prometheus.Alert{
+			{
+				Labels:      prommodel.LabelSet{"alertname": "Down", "service": "a", "team": "core", "severity": "info"},
+				Annotations: prommodel.LabelSet{"summary": "a is down"},
+				State:       prometheus.AlertStateFiring,
+			},
+			{
+				Labels: prommodel.LabelSet{"alertname": "Down", "service": "b", "team": "core"},
+				State:  prometheus.AlertStatePending,
+			},
+			{
+				Labels: prommodel.LabelSet{"alertname": "Errors", "source": "a", "target": "b", "severity": "warning"},
+				State:  prometheus.AlertStateFiring,
+			},
+			{
+				Labels: prommodel.LabelSet{"alertname": "Errors", "source": "b", "target": "c"},
+				State:  prometheus.AlertStateFiring,
+			},
+		},
+	}
+	g := &generator{
+		logger:  zap.NewNop(),
+		metrics: newRetrieverMetrics(nil),
+		querier: q,
+	}
+	conns := []*config.Connection{newTestConnection("up", config.QueryPolicy{})}
+	set, err := g.generateNodeConnectionSet(context.Background(), "cluster-1", conns, nil, alerts, nil, time.Now(), newServiceNode)
+	require.NoError(t, err)
+	assert.Equal(t, "active=true&silenced=false&inhibited=false", query)
+
+	notices := make(map[string][]*model.Notice)
+	for _, n := range set.Nodes {
+		notices[n.Name] = n.Notices
+	}
+	require.Len(t, set.Connections, 1)
+	notices["a/b"] = set.Connections[0].Notices
+
+	assert.Equal(t, map[string][]*model.Notice{
+		"a": {{
+			Title:    "Down",
+			Subtitle: "a is down",
+			Link:     "http://prometheus/graph?g0.expr=ALERTS%7Balertname%3D%22Down%22%7D",
+			Severity: 0,
+		}},
+		"b": {{
+			Title:    "HighLatency",
+			Subtitle: "p99 is 3s",
+			Link:     "http://prometheus/graph?g0.expr=latency",
+			Severity: 2,
+		}},
+		"a/b": {{
+			Title:    "Errors to b",
+			Link:     "http://prometheus/graph?g0.expr=ALERTS%7Balertname%3D%22Errors%22%7D",
+			Severity: 1,
+		}},
+	}, notices)
+
+	g = &generator{
+		logger:     zap.NewNop(),
+		metrics:    newRetrieverMetrics(nil),
+		querier:    q,
+		skipAlerts: true,
+	}
+	set, err = g.generateNodeConnectionSet(context.Background(), "cluster-1", conns, nil, alerts, nil, time.Now(), newServiceNode)
+	require.NoError(t, err)
+	for _, n := range set.Nodes {
+		assert.Empty(t, n.Notices)
+	}
+}
+
+// alertsDownQuerier fails to get alerts.
+type alertsDownQuerier struct {
+	fakeQuerier
+}
+
+func (q *alertsDownQuerier) Alerts(ctx context.Context, server string) ([]prometheus.Alert, error) {
+	return nil, errors.New("unavailable")
+}
+
+func TestAlertNoticesStale(t *testing.T) {
+	nodeMapping := func(label string) *config.NodeMapping {
+		return &config.NodeMapping{Label: label, Regex: config.MustNewRegexp("(.*)"), Replacement: "$1"}
+	}
+	alerts := []*config.AlertNotice{
+		{PrometheusURL: "http://prometheus", Service: nodeMapping("service")},
+		{PrometheusURL: "http://prometheus", Matchers: map[string]string{"alertname": "Errors"}, Source: nodeMapping("source"), Target: nodeMapping("target")},
+	}
+	values := map[string]prommodel.Value{
+		"up": newTestVector("a", "b"),
+	}
+	q := &fakeQuerier{
+		values: values,
+		alerts: []prometheus.Alert{
+			{Labels: prommodel.LabelSet{"alertname": "Down", "service": "a"}, State: prometheus.AlertStateFiring},
+			{Labels: prommodel.LabelSet{"alertname": "Errors", "source": "a", "target": "b"}, State: prometheus.AlertStateFiring},
+		},
+	}
+	conns := []*config.Connection{newTestConnection("up", config.QueryPolicy{})}
+	ts := time.Now()
+	g := &generator{
+		logger:  zap.NewNop(),
+		metrics: newRetrieverMetrics(nil),
+		querier: q,
+	}
+	_, err := g.generateNodeConnectionSet(context.Background(), "cluster-1", conns, nil, alerts, nil, ts, newServiceNode)
+	require.NoError(t, err)
+
+	// The alerts can not be retrieved anymore, so the last ones are reused.
+	g = &generator{
+		logger:      zap.NewNop(),
+		metrics:     newRetrieverMetrics(nil),
+		querier:     &alertsDownQuerier{fakeQuerier: fakeQuerier{values: values}},
+		lastResults: g.results,
+		// The results of the connections are fresh, and the alerts are reused.
+		stalenessWindow: time.Hour,
+	}
+	set, err := g.generateNodeConnectionSet(context.Background(), "cluster-1", conns, nil, alerts, nil, ts.Add(time.Minute), newServiceNode)
+	require.NoError(t, err)
+
+	for _, n := range set.Nodes {
+		assert.Equal(t, n.Name == "a", n.Stale, n.Name)
+	}
+	require.Len(t, set.Connections, 1)
+	conn := set.Connections[0]
+	assert.True(t, conn.Stale)
+	assert.Equal(t, config.StaleClass.Name, conn.Class)
+	require.Len(t, conn.Notices, 2)
+	assert.Equal(t, "Errors", conn.Notices[0].Title)
+	assert.Equal(t, "Stale data", conn.Notices[1].Title)
+}
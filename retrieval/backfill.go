@@ -0,0 +1,122 @@
+package retrieval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nghialv/promviz/config"
+	"github.com/nghialv/promviz/storage"
+	"go.uber.org/zap"
+)
+
+// backfillBatchSize is the number of snapshots generated from one range query
+// per query, which keeps the number of points per series well below the
+// limit of prometheus.
+const backfillBatchSize = 120
+
+type BackfillOptions struct {
+	From            time.Time
+	To              time.Time
+	Step            time.Duration
+	ScrapeTimeout   time.Duration
+	StalenessWindow time.Duration
+	Appender        storage.Appender
+}
+
+// Backfill generates a snapshot for every step between From and To with the
+// queries evaluated at that time and adds it to the appender in ascending order.
+// The queries are sent as range queries covering batches of snapshots.
+// A snapshot which could not be generated or added is logged and skipped.
+func Backfill(ctx context.Context, logger *zap.Logger, cfg *config.Config, opts *BackfillOptions) error {
+	if opts.Step <= 0 {
+		return errors.New("Step must be positive")
+	}
+	if !opts.From.Before(opts.To) {
+		return fmt.Errorf("From (%s) must be before To (%s)", opts.From, opts.To)
+	}
+	if err := cfg.ValidateQueries(); err != nil {
+		return err
+	}
+	metrics := newRetrieverMetrics(nil)
+	q, err := newQuerier(logger, cfg, metrics)
+	if err != nil {
+		return err
+	}
+	defer q.Stop()
+	sources, err := newDataSources(logger, cfg)
+	if err != nil {
+		return err
+	}
+
+	var (
+		discoverer  = newClusterDiscoverer(logger, cfg)
+		lastResults map[string]*queryResult
+		generated   int
+		failed      int
+	)
+
+	var (
+		rq          *rangeQuerier
+		cancelRange context.CancelFunc = func() {}
+	)
+	defer func() { cancelRange() }()
+	for ts := opts.From; !ts.After(opts.To); ts = ts.Add(opts.Step) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		timeout := opts.ScrapeTimeout
+		if rq == nil || ts.After(rq.r.End) {
+			n := int(opts.To.Sub(ts)/opts.Step) + 1
+			if n > backfillBatchSize {
+				n = backfillBatchSize
+			}
+			// The range queries of the batch may take as long as its
+			// snapshots, and the first snapshot waits for them.
+			timeout = time.Duration(n) * opts.ScrapeTimeout
+			cancelRange()
+			rctx, cancel := context.WithTimeout(ctx, timeout)
+			cancelRange = cancel
+			rq = newRangeQuerier(rctx, logger, q, stepRange(ts, opts.Step, n))
+		}
+
+		tctx, cancel := context.WithTimeout(ctx, timeout)
+		cq := newCoalescingQuerier(tctx, rq, metrics)
+		g := &generator{
+			logger:          logger,
+			metrics:         metrics,
+			cfg:             discoverer.apply(tctx, cq, cfg, ts),
+			querier:         cq,
+			sources:         sources,
+			skipAlerts:      true,
+			lastResults:     lastResults,
+			stalenessWindow: opts.StalenessWindow,
+		}
+		snapshot, err := g.generateSnapshot(tctx, ts)
+		cancel()
+		lastResults = nextResults(lastResults, g.results, err != nil)
+
+		if err == nil {
+			err = opts.Appender.Add(snapshot)
+		}
+		if err != nil {
+			failed++
+			logger.Error("Failed to backfill snapshot", zap.Time("ts", ts), zap.Error(err))
+			continue
+		}
+		generated++
+		if generated%100 == 0 {
+			logger.Info("Backfilling snapshots", zap.Time("ts", ts), zap.Int("generated", generated))
+		}
+	}
+
+	logger.Info("Backfilled snapshots", zap.Int("generated", generated), zap.Int("failed", failed))
+	if generated == 0 && failed > 0 {
+		return fmt.Errorf("Failed to backfill all of %d snapshots", failed)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package retrieval
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nghialv/promviz/config"
+	"github.com/nghialv/promviz/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type fakeAppender struct {
+	mtx       sync.Mutex
+	snapshots []*model.Snapshot
+}
+
+func (f *fakeAppender) Add(snapshot *model.Snapshot) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.snapshots = append(f.snapshots, snapshot)
+	return nil
+}
+
+func TestBackfill(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		requests []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		mtx.Lock()
+		requests = append(requests, req.URL.Path+"?"+req.Form.Encode())
+		mtx.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if req.URL.Path == "/api/v1/query_range" {
+			// The sample at 1500000060 is missing, so that step falls back to an instant query.
+			w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"source":"a","target":"b"},"values":[[1500000000,"1"],[1500000120,"2"]]}]}}`))
+			return
+		}
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer srv.Close()
+
+	conn := newTestConnection("up", config.QueryPolicy{})
+	conn.PrometheusURL = srv.URL
+	cfg := &config.Config{
+		GraphName: "backfill",
+		GlobalLevel: config.GlobalLevel{
+			Connections: []*config.Connection{conn},
+		},
+	}
+
+	from := time.Unix(1500000000, 0)
+	appender := &fakeAppender{}
+	err := Backfill(context.Background(), zap.NewNop(), cfg, &BackfillOptions{
+		From:          from,
+		To:            from.Add(2 * time.Minute),
+		Step:          time.Minute,
+		ScrapeTimeout: time.Second,
+		Appender:      appender,
+	})
+	require.NoError(t, err)
+
+	require.Len(t, appender.snapshots, 3)
+	for i, s := range appender.snapshots {
+		assert.Equal(t, from.Add(time.Duration(i)*time.Minute), s.Timestamp)
+		assert.Equal(t, i != 1, strings.Contains(s.GraphJSON, `"source":"a","target":"b"`), i)
+	}
+	assert.Equal(t, []string{
+		"/api/v1/query_range?end=1500000120&query=up&start=1500000000&step=60",
+		"/api/v1/query?query=up&time=1500000060",
+	}, requests)
+}
@@ -0,0 +1,231 @@
+package retrieval
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nghialv/promviz/config"
+	prommodel "github.com/prometheus/common/model"
+	"go.uber.org/zap"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// DataSource provides the samples connections are generated from. The
+// samples are mapped to connections with the source, target and status of
+// the connection in the same way as the result of a prometheus query.
+type DataSource interface {
+	Query(ctx context.Context, conn *config.Connection, ts time.Time) (prommodel.Vector, error)
+}
+
+// DataSourceFactory creates the data source serving every connection of a
+// type in the given config. It is called each time a config is applied.
+type DataSourceFactory func(logger *zap.Logger, cfg *config.Config) (DataSource, error)
+
+var (
+	dataSourcesMtx      sync.RWMutex
+	dataSourceFactories = map[string]DataSourceFactory{
+		config.ConnectionTypeStatic: newStaticSource,
+		config.ConnectionTypeJSON:   newJSONSource,
+		config.ConnectionTypeJaeger: newJaegerSource,
+	}
+)
+
+// RegisterDataSource makes the data source created by factory available to
+// the connections with the given type, which are then accepted by
+// config.Validate. It panics if the type is already registered or is
+// prometheus, which is served by the prometheus servers.
+func RegisterDataSource(typ string, factory DataSourceFactory) {
+	dataSourcesMtx.Lock()
+	defer dataSourcesMtx.Unlock()
+	if typ == "" || typ == config.ConnectionTypePrometheus {
+		panic(fmt.Sprintf("Unabled to register data source type %q", typ))
+	}
+	if _, ok := dataSourceFactories[typ]; ok {
+		panic(fmt.Sprintf("Data source type %q is already registered", typ))
+	}
+	dataSourceFactories[typ] = factory
+	config.RegisterConnectionType(typ)
+}
+
+// newDataSources creates the data sources of every connection type other
+// than prometheus used in cfg.
+func newDataSources(logger *zap.Logger, cfg *config.Config) (map[string]DataSource, error) {
+	dataSourcesMtx.RLock()
+	defer dataSourcesMtx.RUnlock()
+
+	sources := make(map[string]DataSource)
+	add := func(conns []*config.Connection) error {
+		for _, conn := range conns {
+			if conn.IsPrometheus() {
+				continue
+			}
+			if _, ok := sources[conn.Type]; ok {
+				continue
+			}
+			factory, ok := dataSourceFactories[conn.Type]
+			if !ok {
+				return fmt.Errorf("Unknown connection type %q", conn.Type)
+			}
+			s, err := factory(logger, cfg)
+			if err != nil {
+				return fmt.Errorf("Failed to create %s data source: %v", conn.Type, err)
+			}
+			sources[conn.Type] = s
+		}
+		return nil
+	}
+
+	if err := add(cfg.GlobalLevel.Connections); err != nil {
+		return nil, err
+	}
+	clusters := make([]*config.Cluster, 0, len(cfg.ClusterLevel))
+	collect := func(path string, cluster *config.Cluster) {
+		clusters = append(clusters, cluster)
+	}
+	for _, cluster := range cfg.ClusterLevel {
+		cluster.Walk("", collect)
+	}
+	for _, ct := range cfg.ClusterTemplates {
+		if ct.Template != nil {
+			ct.Template.Walk("", collect)
+		}
+	}
+	for _, cluster := range clusters {
+		if err := add(cluster.Connections); err != nil {
+			return nil, err
+		}
+	}
+	return sources, nil
+}
+
+// sourceKey identifies where the samples of a connection come from in the
+// query status, the metrics and the reused results.
+func sourceKey(conn *config.Connection) string {
+	switch conn.Type {
+	case "", config.ConnectionTypePrometheus:
+		return conn.PrometheusKey()
+	case config.ConnectionTypeStatic:
+		return conn.Type + ":" + conn.File
+	}
+	return conn.Type + ":" + conn.URL
+}
+
+// promSource is the default data source sending the query of a connection
+// to its prometheus server.
+type promSource struct {
+	querier querier
+}
+
+func (s *promSource) Query(ctx context.Context, conn *config.Connection, ts time.Time) (prommodel.Vector, error) {
+	value, err := s.querier.Query(ctx, conn.PrometheusKey(), conn.Query, ts)
+	if err != nil {
+		return nil, err
+	}
+	vector, ok := value.(prommodel.Vector)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected type of query result: %s", value.Type())
+	}
+	return vector, nil
+}
+
+// edge is an entry of the edge lists read by the static and json data
+// sources. It becomes a sample labelled with source, target and its labels.
+type edge struct {
+	Source string            `json:"source" yaml:"source"`
+	Target string            `json:"target" yaml:"target"`
+	Value  float64           `json:"value" yaml:"value"`
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
+
+func edgesToVector(edges []*edge, ts time.Time) prommodel.Vector {
+	vector := make(prommodel.Vector, 0, len(edges))
+	for _, e := range edges {
+		metric := make(prommodel.Metric, len(e.Labels)+2)
+		for k, v := range e.Labels {
+			metric[prommodel.LabelName(k)] = prommodel.LabelValue(v)
+		}
+		metric["source"] = prommodel.LabelValue(e.Source)
+		metric["target"] = prommodel.LabelValue(e.Target)
+		vector = append(vector, &prommodel.Sample{
+			Metric:    metric,
+			Value:     prommodel.SampleValue(e.Value),
+			Timestamp: prommodel.TimeFromUnixNano(ts.UnixNano()),
+		})
+	}
+	return vector
+}
+
+// staticSource reads the edge list of a connection from a JSON or YAML file,
+// e.g. for third-party dependencies which can not be instrumented. The file
+// is read on every query so it can be edited without reloading the config.
+type staticSource struct{}
+
+func newStaticSource(logger *zap.Logger, cfg *config.Config) (DataSource, error) {
+	return &staticSource{}, nil
+}
+
+func (s *staticSource) Query(ctx context.Context, conn *config.Connection, ts time.Time) (prommodel.Vector, error) {
+	data, err := ioutil.ReadFile(conn.File)
+	if err != nil {
+		return nil, err
+	}
+	var edges []*edge
+	// JSON is a subset of YAML, so both are decoded by the YAML decoder.
+	if err := yaml.UnmarshalStrict(data, &edges); err != nil {
+		return nil, fmt.Errorf("Failed to decode edge list %s: %v", conn.File, err)
+	}
+	return edgesToVector(edges, ts), nil
+}
+
+// jsonSource fetches the edge list of a connection from an HTTP endpoint
+// returning a JSON array of edges. The evaluation time and the query of the
+// connection, if any, are sent as the time and query parameters.
+type jsonSource struct {
+	client *http.Client
+}
+
+func newJSONSource(logger *zap.Logger, cfg *config.Config) (DataSource, error) {
+	return &jsonSource{
+		client: &http.Client{},
+	}, nil
+}
+
+func (s *jsonSource) Query(ctx context.Context, conn *config.Connection, ts time.Time) (prommodel.Vector, error) {
+	u, err := url.Parse(conn.URL)
+	if err != nil {
+		return nil, err
+	}
+	params := u.Query()
+	params.Set("time", strconv.FormatInt(ts.Unix(), 10))
+	if conn.Query != "" {
+		params.Set("query", conn.Query)
+	}
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("Unexpected status %s from %s", resp.Status, conn.URL)
+	}
+	var edges []*edge
+	if err := json.NewDecoder(resp.Body).Decode(&edges); err != nil {
+		return nil, fmt.Errorf("Failed to decode edge list from %s: %v", conn.URL, err)
+	}
+	return edgesToVector(edges, ts), nil
+}
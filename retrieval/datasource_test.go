@@ -0,0 +1,121 @@
+package retrieval
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/nghialv/promviz/config"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type constSource prommodel.Vector
+
+func (s constSource) Query(ctx context.Context, conn *config.Connection, ts time.Time) (prommodel.Vector, error) {
+	return prommodel.Vector(s), nil
+}
+
+func TestDataSources(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "edges.yaml")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`
+- source: web
+  target: stripe
+  value: 3
+  labels:
+    code: "200"
+`), 0644))
+
+	var gotQuery, gotTime string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotQuery = req.URL.Query().Get("query")
+		gotTime = req.URL.Query().Get("time")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"source": "web", "target": "auth0", "value": 2},
+		})
+	}))
+	defer srv.Close()
+
+	RegisterDataSource("test-const", func(logger *zap.Logger, cfg *config.Config) (DataSource, error) {
+		return constSource(newTestVector("web", "legacy")), nil
+	})
+	assert.Panics(t, func() {
+		RegisterDataSource(config.ConnectionTypePrometheus, nil)
+	})
+
+	static := newTestConnection("", config.QueryPolicy{})
+	static.Type, static.PrometheusURL, static.File = config.ConnectionTypeStatic, "", file
+	jsonConn := newTestConnection("external", config.QueryPolicy{})
+	jsonConn.Type, jsonConn.PrometheusURL, jsonConn.URL = config.ConnectionTypeJSON, "", srv.URL
+	custom := newTestConnection("", config.QueryPolicy{})
+	custom.Type, custom.PrometheusURL = "test-const", ""
+
+	cfg := &config.Config{
+		ClusterLevel: []*config.Cluster{
+			{
+				Cluster: "cluster-1",
+				Connections: []*config.Connection{
+					newTestConnection("internal", config.QueryPolicy{}),
+					static,
+					jsonConn,
+					custom,
+				},
+			},
+		},
+	}
+	sources, err := newDataSources(zap.NewNop(), cfg)
+	require.NoError(t, err)
+	assert.Len(t, sources, 3)
+
+	ts := time.Unix(1600000000, 0)
+	g := &generator{
+		logger:  zap.NewNop(),
+		metrics: newRetrieverMetrics(nil),
+		cfg:     cfg,
+		querier: &fakeQuerier{
+			values: map[string]prommodel.Value{
+				"internal": newTestVector("web", "api"),
+			},
+		},
+		sources: sources,
+	}
+	set, err := g.generateNodeConnectionSet(context.Background(), "cluster-1", cfg.ClusterLevel[0].Connections, nil, nil, nil, ts, newServiceNode)
+	require.NoError(t, err)
+
+	targets := make(map[string]float64)
+	for _, c := range set.Connections {
+		targets[c.Target] = c.Metrics.Normal
+	}
+	assert.Equal(t, map[string]float64{"api": 1, "stripe": 3, "auth0": 2, "legacy": 1}, targets)
+	assert.Equal(t, "external", gotQuery)
+	assert.Equal(t, "1600000000", gotTime)
+
+	status := make([]string, 0, len(g.queryStatus))
+	for _, s := range g.queryStatus {
+		status = append(status, s.Prometheus)
+	}
+	sort.Strings(status)
+	assert.Equal(t, []string{"http://prometheus", "json:" + srv.URL, "static:" + file, "test-const:"}, status)
+
+	custom.Type = "unknown"
+	_, err = newDataSources(zap.NewNop(), cfg)
+	assert.EqualError(t, err, `Unknown connection type "unknown"`)
+}
+
+func TestStaticSourceInvalidFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "edges.json")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`[{"source": "a", "dest": "b"}]`), 0644))
+
+	_, err := (&staticSource{}).Query(context.Background(), &config.Connection{File: file}, time.Now())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Failed to decode edge list")
+}
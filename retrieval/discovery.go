@@ -0,0 +1,139 @@
+package retrieval
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nghialv/promviz/config"
+	"github.com/nghialv/promviz/model"
+	prommodel "github.com/prometheus/common/model"
+	"go.uber.org/zap"
+)
+
+// clusterDiscoverer instantiates the cluster templates for the label values
+// returned by their discovery queries. The last successful result of each
+// template is kept, so a failed discovery does not remove its clusters.
+type clusterDiscoverer struct {
+	logger      *zap.Logger
+	templates   []*config.ClusterTemplate
+	clusters    [][]*config.Cluster
+	lastRefresh []time.Time
+	status      []*model.QueryStatus
+}
+
+func newClusterDiscoverer(logger *zap.Logger, cfg *config.Config) *clusterDiscoverer {
+	return &clusterDiscoverer{
+		logger:      logger,
+		templates:   cfg.ClusterTemplates,
+		clusters:    make([][]*config.Cluster, len(cfg.ClusterTemplates)),
+		lastRefresh: make([]time.Time, len(cfg.ClusterTemplates)),
+		status:      make([]*model.QueryStatus, len(cfg.ClusterTemplates)),
+	}
+}
+
+// apply returns a copy of cfg whose ClusterLevel also contains the discovered clusters.
+// Discovered clusters whose name is already used by another cluster are ignored.
+func (d *clusterDiscoverer) apply(ctx context.Context, q querier, cfg *config.Config, ts time.Time) *config.Config {
+	if len(d.templates) == 0 {
+		return cfg
+	}
+	d.refresh(ctx, q, ts)
+
+	names := make(map[string]struct{}, len(cfg.ClusterLevel))
+	clusters := make([]*config.Cluster, 0, len(cfg.ClusterLevel))
+	for _, c := range cfg.ClusterLevel {
+		names[c.Cluster] = struct{}{}
+		clusters = append(clusters, c)
+	}
+	for _, cs := range d.clusters {
+		for _, c := range cs {
+			if _, ok := names[c.Cluster]; ok {
+				d.logger.Warn("Ignored discovered cluster whose name is already used", zap.String("cluster", c.Cluster))
+				continue
+			}
+			names[c.Cluster] = struct{}{}
+			clusters = append(clusters, c)
+		}
+	}
+
+	effective := *cfg
+	effective.ClusterLevel = clusters
+	return &effective
+}
+
+func (d *clusterDiscoverer) refresh(ctx context.Context, q querier, ts time.Time) {
+	for i, ct := range d.templates {
+		if !d.lastRefresh[i].IsZero() && ts.Sub(d.lastRefresh[i]) < time.Duration(ct.RefreshInterval) {
+			continue
+		}
+		logger := d.logger.With(
+			zap.String("prometheus", ct.Discovery.PrometheusKey()),
+			zap.String("query", ct.Discovery.Query))
+
+		status := &model.QueryStatus{
+			Query:      fmt.Sprintf("clusterTemplates[%d].discovery", i),
+			Expr:       ct.Discovery.Query,
+			Prometheus: ct.Discovery.PrometheusKey(),
+			LastRun:    time.Now(),
+		}
+		d.status[i] = status
+		value, err := q.Query(ctx, ct.Discovery.PrometheusKey(), ct.Discovery.Query, ts)
+		status.DurationSeconds = time.Since(status.LastRun).Seconds()
+		if err != nil {
+			status.Error = err.Error()
+			logger.Error("Failed to send discovery query", zap.Error(err))
+			continue
+		}
+		vector, ok := value.(prommodel.Vector)
+		if !ok {
+			logger.Info("Unexpected type", zap.Any("value", value))
+			continue
+		}
+		status.Series = len(vector)
+
+		clusters := make([]*config.Cluster, 0, len(vector))
+		for _, v := range discoveredValues(vector, ct.Discovery.Label) {
+			c, err := ct.Instantiate(v)
+			if err != nil {
+				logger.Error("Failed to instantiate cluster template", zap.Error(err), zap.String("value", v))
+				continue
+			}
+			clusters = append(clusters, c)
+		}
+		d.clusters[i] = clusters
+		d.lastRefresh[i] = ts
+	}
+}
+
+// queryStatus returns the status of the latest run of the discovery queries
+// and the queries of the templates which have not discovered any cluster,
+// which are skipped.
+func (d *clusterDiscoverer) queryStatus() []*model.QueryStatus {
+	status := make([]*model.QueryStatus, 0)
+	for i, ct := range d.templates {
+		if d.status[i] != nil {
+			status = append(status, d.status[i])
+		}
+		if len(d.clusters[i]) == 0 && ct.Template != nil {
+			status = append(status, skippedQueryStatus(fmt.Sprintf("clusterTemplates[%d]", i), ct.Template)...)
+		}
+	}
+	return status
+}
+
+func discoveredValues(vector prommodel.Vector, label string) []string {
+	set := make(map[string]struct{}, len(vector))
+	for _, s := range vector {
+		if v := string(s.Metric[prommodel.LabelName(label)]); v != "" {
+			set[v] = struct{}{}
+		}
+	}
+	values := make([]string, 0, len(set))
+	for v := range set {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return values
+}
@@ -0,0 +1,93 @@
+package retrieval
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nghialv/promviz/config"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestClusterDiscoverer(t *testing.T) {
+	discovered := func(clusters ...string) prommodel.Vector {
+		vector := make(prommodel.Vector, 0, len(clusters))
+		for _, c := range clusters {
+			vector = append(vector, &prommodel.Sample{
+				Metric: prommodel.Metric{"cluster": prommodel.LabelValue(c)},
+				Value:  1,
+			})
+		}
+		return vector
+	}
+	cfg := &config.Config{
+		ClusterLevel: []*config.Cluster{
+			{Cluster: "static", Connections: []*config.Connection{newTestConnection("static", config.QueryPolicy{})}},
+		},
+		ClusterTemplates: []*config.ClusterTemplate{
+			{
+				Discovery:       config.ClusterDiscovery{Query: "clusters", Label: "cluster", PrometheusURL: "http://prometheus"},
+				RefreshInterval: prommodel.Duration(time.Minute),
+				Template: &config.Cluster{
+					Connections: []*config.Connection{newTestConnection(`requests{cluster="{{ .cluster }}"}`, config.QueryPolicy{})},
+				},
+			},
+		},
+	}
+	q := &fakeQuerier{
+		values: map[string]prommodel.Value{
+			"clusters": discovered("b", "a", "static", "a"),
+		},
+	}
+	d := newClusterDiscoverer(zap.NewNop(), cfg)
+	ts := time.Unix(1500000000, 0)
+
+	names := func(cfg *config.Config) []string {
+		names := make([]string, 0, len(cfg.ClusterLevel))
+		for _, c := range cfg.ClusterLevel {
+			names = append(names, c.Cluster)
+		}
+		return names
+	}
+
+	// A cluster is instantiated per discovered value, and the value
+	// colliding with the static cluster is ignored.
+	effective := d.apply(context.Background(), q, cfg, ts)
+	assert.Equal(t, []string{"static", "a", "b"}, names(effective))
+	assert.Equal(t, `requests{cluster="a"}`, effective.ClusterLevel[1].Connections[0].Query)
+	assert.Equal(t, "static", effective.ClusterLevel[0].Connections[0].Query)
+	assert.Len(t, cfg.ClusterLevel, 1)
+	assert.Equal(t, 1, q.calls["clusters"])
+
+	// The discovery query is not sent again within the refresh interval.
+	q.values["clusters"] = discovered("a", "b", "c")
+	effective = d.apply(context.Background(), q, cfg, ts.Add(30*time.Second))
+	assert.Equal(t, []string{"static", "a", "b"}, names(effective))
+	assert.Equal(t, 1, q.calls["clusters"])
+
+	effective = d.apply(context.Background(), q, cfg, ts.Add(time.Minute))
+	assert.Equal(t, []string{"static", "a", "b", "c"}, names(effective))
+	assert.Equal(t, 2, q.calls["clusters"])
+
+	// A failed discovery keeps the last clusters and is retried on the next snapshot.
+	q.failures = map[string]int{"clusters": 3}
+	q.values["clusters"] = discovered("d")
+	effective = d.apply(context.Background(), q, cfg, ts.Add(2*time.Minute))
+	assert.Equal(t, []string{"static", "a", "b", "c"}, names(effective))
+	assert.Equal(t, 3, q.calls["clusters"])
+	status := d.queryStatus()
+	require.Len(t, status, 1)
+	assert.Equal(t, "clusterTemplates[0].discovery", status[0].Query)
+	assert.Equal(t, "unavailable", status[0].Error)
+
+	effective = d.apply(context.Background(), q, cfg, ts.Add(2*time.Minute+time.Second))
+	assert.Equal(t, []string{"static", "d"}, names(effective))
+	assert.Equal(t, 4, q.calls["clusters"])
+	status = d.queryStatus()
+	require.Len(t, status, 1)
+	assert.Empty(t, status[0].Error)
+	assert.Equal(t, 1, status[0].Series)
+}
@@ -6,8 +6,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"math"
+	"sync"
 	"time"
 
+	"github.com/cenkalti/backoff"
 	"github.com/nghialv/promviz/config"
 	"github.com/nghialv/promviz/model"
 	prommodel "github.com/prometheus/common/model"
@@ -15,20 +18,55 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+// DefaultRetryBackoff is the initial backoff between the retries of a query
+// without retryBackoff. The backoff grows exponentially on each retry.
+var DefaultRetryBackoff = 500 * time.Millisecond
+
 type generator struct {
 	logger  *zap.Logger
+	metrics *retrieverMetrics
 	cfg     *config.Config
 	querier querier
+	// sources are the data sources of the connections which are not
+	// generated from prometheus queries, keyed by connection type.
+	sources map[string]DataSource
+	// skipAlerts is set when generating past snapshots, for which the
+	// current alerts would be wrong.
+	skipAlerts bool
+
+	// lastResults are the query results used by the previous snapshot,
+	// which are reused by the queries with onError: reuseLast as long as
+	// they are not older than stalenessWindow.
+	lastResults     map[string]*queryResult
+	stalenessWindow time.Duration
+
+	mtx           sync.Mutex
+	results       map[string]*queryResult
+	failedQueries []*model.FailedQuery
+	queryStatus   []*model.QueryStatus
+}
+
+// queryResult is the value of a query and the time it was successfully retrieved.
+type queryResult struct {
+	value     prommodel.Value
+	timestamp time.Time
+}
+
+// staleness returns how old the result is at ts. Zero means the result is fresh.
+func (r *queryResult) staleness(ts time.Time) time.Duration {
+	return ts.Sub(r.timestamp)
 }
 
 func (g *generator) generateSnapshot(ctx context.Context, ts time.Time) (*model.Snapshot, error) {
 	group, groupCtx := errgroup.WithContext(ctx)
 	var clusters *model.NodeConnectionSet
-	services := make(map[string]*model.NodeConnectionSet)
-	clusterMap := make(map[string]*config.Cluster, len(g.cfg.ClusterLevel))
+	var levelsMtx sync.Mutex
+	// levels are the nodes and connections inside each node declared in
+	// clusterLevel or a childLevel, keyed by the level id.
+	levels := make(map[string]*model.NodeConnectionSet)
 
 	group.Go(func() error {
-		cs, err := g.generateNodeConnectionSet(groupCtx, g.cfg.GlobalLevel.Connections, nil, ts, newClusterNode)
+		cs, err := g.generateNodeConnectionSet(groupCtx, "", g.cfg.GlobalLevel.Connections, nil, g.cfg.GlobalLevel.AlertNotices, nil, ts, newClusterNode)
 		if err != nil {
 			return err
 		}
@@ -36,18 +74,24 @@ func (g *generator) generateSnapshot(ctx context.Context, ts time.Time) (*model.
 		return nil
 	})
 
-	for _, cluster := range g.cfg.ClusterLevel {
-		cluster := cluster
-		clusterMap[cluster.Cluster] = cluster
-
+	var generateLevel func(id string, cluster *config.Cluster)
+	generateLevel = func(id string, cluster *config.Cluster) {
 		group.Go(func() error {
-			ss, err := g.generateNodeConnectionSet(groupCtx, cluster.Connections, cluster.NodeNotices, ts, newServiceNode)
+			ss, err := g.generateNodeConnectionSet(groupCtx, id, cluster.Connections, cluster.NodeNotices, cluster.AlertNotices, cluster.NodeMetadata, ts, newServiceNode)
 			if err != nil {
 				return err
 			}
-			services[cluster.Cluster] = ss
+			levelsMtx.Lock()
+			levels[id] = groupNodes(ss, cluster.Groups)
+			levelsMtx.Unlock()
 			return nil
 		})
+		for _, child := range cluster.ChildLevel {
+			generateLevel(levelID(id, child.Cluster), child)
+		}
+	}
+	for _, cluster := range g.cfg.ClusterLevel {
+		generateLevel(cluster.Cluster, cluster)
 	}
 
 	if err := group.Wait(); err != nil {
@@ -55,10 +99,13 @@ func (g *generator) generateSnapshot(ctx context.Context, ts time.Time) (*model.
 	}
 
 	classes := make([]*model.Class, 0, len(g.cfg.Classes))
-	found := false
+	found, foundStale := false, false
 	for _, c := range g.cfg.Classes {
-		if c.Name == "default" {
+		switch c.Name {
+		case config.DefaultClass.Name:
 			found = true
+		case config.StaleClass.Name:
+			foundStale = true
 		}
 		classes = append(classes, &model.Class{
 			Name:  c.Name,
@@ -71,17 +118,21 @@ func (g *generator) generateSnapshot(ctx context.Context, ts time.Time) (*model.
 			Color: config.DefaultClass.Color,
 		})
 	}
-
-	for _, n := range clusters.Nodes {
-		if cluster, ok := services[n.Name]; ok {
-			n.Nodes = cluster.Nodes
-			n.Connections = cluster.Connections
-			n.MaxVolume = clusterMap[n.Name].MaxVolume // calculateMaxVolume(cluster.Nodes, cluster.Connections, clusterMap[n.Name].MaxVolumeRate)
-		}
+	if !foundStale {
+		classes = append(classes, &model.Class{
+			Name:  config.StaleClass.Name,
+			Color: config.StaleClass.Color,
+		})
 	}
 
+	attachLevels(levels, "", clusters.Nodes, g.cfg.ClusterLevel)
+
+	renderer := g.cfg.GlobalLevel.Renderer
+	if renderer == "" {
+		renderer = config.RendererGlobal
+	}
 	graph := &model.VizceralGraph{
-		Renderer:         "global",
+		Renderer:         renderer,
 		Name:             g.cfg.GraphName,
 		MaxVolume:        g.cfg.GlobalLevel.MaxVolume, // calculateMaxVolume(clusters.Nodes, clusters.Connections, g.cfg.GlobalLevel.MaxVolumeRate),
 		ServerUpdateTime: ts.Unix(),
@@ -95,74 +146,235 @@ func (g *generator) generateSnapshot(ctx context.Context, ts time.Time) (*model.
 	}
 
 	snapshot := &model.Snapshot{
-		Timestamp: ts,
-		GraphJSON: string(jsondata),
+		Timestamp:     ts,
+		GraphJSON:     string(jsondata),
+		FailedQueries: g.failedQueries,
 	}
 
 	return snapshot, nil
 }
 
-func (g *generator) generateNodeConnectionSet(ctx context.Context, cfgConns []*config.Connection, cfgNotices []*config.NodeNotice, ts time.Time, nodeFactory func(string) *model.Node) (*model.NodeConnectionSet, error) {
+// levelID returns the id of the level inside the node named name of the
+// level parent, e.g. region-1/cluster-1/namespace-1. It is also the cluster
+// of the queries of the level in the query status.
+func levelID(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "/" + name
+}
+
+// attachLevels sets the nodes and connections inside each of nodes which is
+// declared in cfgLevel, then does the same for their own nodes.
+func attachLevels(levels map[string]*model.NodeConnectionSet, parent string, nodes []*model.Node, cfgLevel []*config.Cluster) {
+	clusterMap := make(map[string]*config.Cluster, len(cfgLevel))
+	for _, cluster := range cfgLevel {
+		clusterMap[cluster.Cluster] = cluster
+	}
+	for _, n := range nodes {
+		cluster, ok := clusterMap[n.Name]
+		if !ok {
+			// The nodes of a drill-down group are nodes of the same level.
+			if len(n.Nodes) > 0 {
+				attachLevels(levels, parent, n.Nodes, cfgLevel)
+			}
+			continue
+		}
+		id := levelID(parent, n.Name)
+		set, ok := levels[id]
+		if !ok {
+			continue
+		}
+		n.Nodes = set.Nodes
+		n.Connections = set.Connections
+		n.MaxVolume = cluster.MaxVolume // calculateMaxVolume(set.Nodes, set.Connections, cluster.MaxVolumeRate)
+		n.Renderer = config.RendererRegion
+		if cluster.Renderer != "" {
+			n.Renderer = cluster.Renderer
+		}
+		attachLevels(levels, id, set.Nodes, cluster.ChildLevel)
+	}
+}
+
+func (g *generator) generateNodeConnectionSet(ctx context.Context, cluster string, cfgConns []*config.Connection, cfgNotices []*config.NodeNotice, cfgAlerts []*config.AlertNotice, cfgMetadata []*config.NodeMeta, ts time.Time, nodeFactory func(string) *model.Node) (*model.NodeConnectionSet, error) {
 	group, groupCtx := errgroup.WithContext(ctx)
 	groupConns := make([]([]*model.Connection), len(cfgConns), len(cfgConns))
+	groupStaleness := make([]time.Duration, len(cfgConns), len(cfgConns))
+	// The extra metrics of each connection by metric index, which are
+	// queried concurrently with the connection.
+	groupMetrics := make([]([]map[string]float64), len(cfgConns), len(cfgConns))
+
+	connKey := "serviceConnections"
+	if cluster == "" {
+		connKey = "clusterConnections"
+	}
+
+	for i, cfgConn := range cfgConns {
+		i, cfgConn := i, cfgConn
+		groupMetrics[i] = make([]map[string]float64, len(cfgConn.Metrics))
+		for j, m := range cfgConn.Metrics {
+			j, m := j, m
+			group.Go(func() error {
+				id := fmt.Sprintf("%s[%d].metrics[%d]", connKey, i, j)
+				values, err := g.queryConnectionMetric(groupCtx, cluster, id, cfgConn, m, ts)
+				groupMetrics[i][j] = values
+				return err
+			})
+		}
+	}
+
+	groupVectors := make([]prommodel.Vector, len(cfgConns), len(cfgConns))
+	groupStatus := make([]*model.QueryStatus, len(cfgConns), len(cfgConns))
 
 	for i, cfgConn := range cfgConns {
 		i, cfgConn := i, cfgConn
 		group.Go(func() error {
-			value, err := g.querier.Query(groupCtx, cfgConn.PrometheusURL, cfgConn.Query, ts)
-			if err != nil {
-				g.logger.Error("Failed to send prom query",
-					zap.Error(err),
-					zap.String("prometheusURL", cfgConn.PrometheusURL),
-					zap.String("query", cfgConn.Query),
-				)
+			status := g.newQueryStatus(cluster, fmt.Sprintf("%s[%d]", connKey, i), sourceKey(cfgConn), cfgConn.Query)
+			source := g.dataSource(cfgConn)
+			result, err := g.query(groupCtx, status, cfgConn.QueryPolicy, ts, func(ctx context.Context) (prommodel.Value, error) {
+				if source == nil {
+					return nil, fmt.Errorf("Unknown connection type %q", cfgConn.Type)
+				}
+				return source.Query(ctx, cfgConn, ts)
+			})
+			if err != nil || result == nil {
 				return err
 			}
-			vector, ok := value.(prommodel.Vector)
+			vector, ok := result.value.(prommodel.Vector)
 			if !ok {
-				g.logger.Info("Unexpected type", zap.Any("value", value))
+				g.logger.Info("Unexpected type", zap.Any("value", result.value))
 				return nil
 			}
-			groupConns[i] = g.generateConnections(vector, cfgConn)
+			groupVectors[i], groupStatus[i] = vector, status
+			groupStaleness[i] = result.staleness(ts)
 			return nil
 		})
 	}
 
 	groupNotices := make([](map[string][]*model.Notice), len(cfgNotices), len(cfgNotices))
+	staleNotices := make([]time.Duration, len(cfgNotices), len(cfgNotices))
 
 	for i, cfgNoti := range cfgNotices {
 		i, cfgNoti := i, cfgNoti
 		group.Go(func() error {
-			value, err := g.querier.Query(groupCtx, cfgNoti.PrometheusURL, cfgNoti.Query, ts)
-			if err != nil {
-				g.logger.Error("Failed to send promQuery",
-					zap.Error(err),
-					zap.String("prometheusURL", cfgNoti.PrometheusURL),
-					zap.String("query", cfgNoti.Query),
-				)
-				// TODO: return nil or error
+			status := g.newQueryStatus(cluster, fmt.Sprintf("serviceNotices[%d]", i), cfgNoti.PrometheusKey(), cfgNoti.Query)
+			result, err := g.query(groupCtx, status, cfgNoti.QueryPolicy, ts, func(ctx context.Context) (prommodel.Value, error) {
+				return g.querier.Query(ctx, cfgNoti.PrometheusKey(), cfgNoti.Query, ts)
+			})
+			if err != nil || result == nil {
+				return err
+			}
+			vector, ok := result.value.(prommodel.Vector)
+			if !ok {
+				g.logger.Info("Unexpected type", zap.Any("value", result.value))
+				return nil
+			}
+			var dropped int
+			groupNotices[i], dropped = g.generateNodeNotices(vector, cfgNoti)
+			g.recordSamples(status, len(vector), dropped)
+			staleNotices[i] = result.staleness(ts)
+			return nil
+		})
+	}
+
+	groupAlerts := make([](map[string][]*model.Notice), len(cfgAlerts), len(cfgAlerts))
+	staleAlerts := make([]time.Duration, len(cfgAlerts), len(cfgAlerts))
+
+	for i, cfgAlert := range cfgAlerts {
+		if g.skipAlerts {
+			break
+		}
+		i, cfgAlert := i, cfgAlert
+		group.Go(func() error {
+			status := g.newQueryStatus(cluster, fmt.Sprintf("alertNotices[%d]", i), alertSourceKey(cfgAlert), alertExpr(cfgAlert))
+			result, err := g.query(groupCtx, status, cfgAlert.QueryPolicy, ts, func(ctx context.Context) (prommodel.Value, error) {
+				return g.fetchAlerts(ctx, cfgAlert, ts)
+			})
+			if err != nil || result == nil {
+				return err
+			}
+			vector, ok := result.value.(prommodel.Vector)
+			if !ok {
+				g.logger.Info("Unexpected type", zap.Any("value", result.value))
 				return nil
 			}
-			vector, ok := value.(prommodel.Vector)
+			var dropped int
+			groupAlerts[i], dropped = g.generateAlertNotices(vector, cfgAlert)
+			g.recordSamples(status, len(vector), dropped)
+			staleAlerts[i] = result.staleness(ts)
+			return nil
+		})
+	}
+
+	groupMetadata := make([](map[string]*nodeMetadata), len(cfgMetadata), len(cfgMetadata))
+	staleMetadata := make([]time.Duration, len(cfgMetadata), len(cfgMetadata))
+
+	for i, cfgMeta := range cfgMetadata {
+		i, cfgMeta := i, cfgMeta
+		group.Go(func() error {
+			status := g.newQueryStatus(cluster, fmt.Sprintf("serviceMetadata[%d]", i), cfgMeta.PrometheusKey(), cfgMeta.Query)
+			result, err := g.query(groupCtx, status, cfgMeta.QueryPolicy, ts, func(ctx context.Context) (prommodel.Value, error) {
+				return g.querier.Query(ctx, cfgMeta.PrometheusKey(), cfgMeta.Query, ts)
+			})
+			if err != nil || result == nil {
+				return err
+			}
+			vector, ok := result.value.(prommodel.Vector)
 			if !ok {
-				g.logger.Info("Unexpected type", zap.Any("value", value))
+				g.logger.Info("Unexpected type", zap.Any("value", result.value))
 				return nil
 			}
-			groupNotices[i] = g.generateNodeNotices(vector, cfgNoti)
+			var dropped int
+			groupMetadata[i], dropped = g.generateNodeMetadata(vector, cfgMeta)
+			g.recordSamples(status, len(vector), dropped)
+			staleMetadata[i] = result.staleness(ts)
 			return nil
 		})
 	}
 
+	// Only the queries with onError: failSnapshot return an error.
 	if err := group.Wait(); err != nil {
-		g.logger.Error("Failed to generate NodeConnectionSet", zap.Error(err))
-		// TODO: should fast return or not
-		// return nil, err
+		return nil, err
+	}
+
+	for i, cfgConn := range cfgConns {
+		if groupStatus[i] == nil {
+			continue
+		}
+		metricValues := make(map[string]map[string]float64)
+		for j, m := range cfgConn.Metrics {
+			for key, v := range groupMetrics[i][j] {
+				if _, ok := metricValues[key]; !ok {
+					metricValues[key] = make(map[string]float64, len(cfgConn.Metrics))
+				}
+				metricValues[key][m.Name] = v
+			}
+		}
+		var dropped int
+		groupConns[i], dropped = g.generateConnections(groupVectors[i], cfgConn, metricValues)
+		g.recordSamples(groupStatus[i], len(groupVectors[i]), dropped)
+		if groupStaleness[i] > 0 {
+			for _, conn := range groupConns[i] {
+				markStaleConnection(conn, groupStaleness[i], cfgConn.QueryLink())
+			}
+		}
 	}
 
 	nodeMap := make(map[string]*model.Node)
+	// staleNodes keeps the largest staleness of the results feeding each node.
+	staleNodes := make(map[string]time.Duration)
+	markStale := func(name string, staleness time.Duration) {
+		if staleness > staleNodes[name] {
+			staleNodes[name] = staleness
+		}
+	}
 
 	for i, cfgConn := range cfgConns {
 		for _, conn := range groupConns[i] {
+			if conn.Stale {
+				markStale(conn.Source, groupStaleness[i])
+				markStale(conn.Target, groupStaleness[i])
+			}
 			ns := []struct {
 				Name  string
 				Class string
@@ -185,18 +397,72 @@ func (g *generator) generateNodeConnectionSet(ctx context.Context, cfgConns []*c
 		for k, noti := range groupNotices[i] {
 			if node, ok := nodeMap[k]; ok {
 				node.Notices = append(node.Notices, noti...)
+				if staleNotices[i] > 0 {
+					markStale(k, staleNotices[i])
+				}
 			}
 		}
 	}
 
-	nodes := make([]*model.Node, 0, len(nodeMap))
-	for _, n := range nodeMap {
-		nodes = append(nodes, n)
+	// Metadata is only attached to the nodes of the graph, in the order of
+	// the serviceMetadata so that later entries override earlier ones.
+	for i := range groupMetadata {
+		for k, meta := range groupMetadata[i] {
+			node, ok := nodeMap[k]
+			if !ok {
+				continue
+			}
+			meta.apply(node)
+			if staleMetadata[i] > 0 {
+				markStale(k, staleMetadata[i])
+			}
+		}
 	}
 
 	connections := make([]*model.Connection, 0)
+	connMap := make(map[string]*model.Connection)
 	for i := range groupConns {
 		connections = append(connections, groupConns[i]...)
+		for _, conn := range groupConns[i] {
+			connMap[connectionKey(conn.Source, conn.Target)] = conn
+		}
+	}
+
+	// Alerts are only shown on the nodes and connections of the graph.
+	staleConns := make(map[string]time.Duration)
+	for i, cfgAlert := range cfgAlerts {
+		for k, noti := range groupAlerts[i] {
+			if cfgAlert.Service == nil {
+				if conn, ok := connMap[k]; ok {
+					conn.Notices = append(conn.Notices, noti...)
+					if staleAlerts[i] > staleConns[k] {
+						staleConns[k] = staleAlerts[i]
+					}
+				}
+				continue
+			}
+			if node, ok := nodeMap[k]; ok {
+				node.Notices = append(node.Notices, noti...)
+				if staleAlerts[i] > 0 {
+					markStale(k, staleAlerts[i])
+				}
+			}
+		}
+	}
+
+	for name, staleness := range staleNodes {
+		markStaleNode(nodeMap[name], staleness)
+	}
+	for k, staleness := range staleConns {
+		// Connections generated from a reused result are already marked.
+		if conn := connMap[k]; !conn.Stale {
+			markStaleConnection(conn, staleness, "")
+		}
+	}
+
+	nodes := make([]*model.Node, 0, len(nodeMap))
+	for _, n := range nodeMap {
+		nodes = append(nodes, n)
 	}
 
 	set := &model.NodeConnectionSet{
@@ -207,7 +473,277 @@ func (g *generator) generateNodeConnectionSet(ctx context.Context, cfgConns []*c
 	return set, nil
 }
 
-func (g *generator) generateConnections(vector prommodel.Vector, conn *config.Connection) []*model.Connection {
+// newQueryStatus returns the status of a query run for the snapshot, which is
+// reported once the snapshot is generated. Its LastRun is now rather than the
+// time of the snapshot, which is in the past for catch-up snapshots.
+func (g *generator) newQueryStatus(cluster, id, server, query string) *model.QueryStatus {
+	status := &model.QueryStatus{
+		Cluster:    cluster,
+		Query:      id,
+		Expr:       query,
+		Prometheus: server,
+		LastRun:    time.Now(),
+	}
+	g.mtx.Lock()
+	g.queryStatus = append(g.queryStatus, status)
+	g.mtx.Unlock()
+	return status
+}
+
+// skippedQueryStatus returns the status of every query of the cluster whose
+// id is given and of its child levels, marked as skipped.
+func skippedQueryStatus(id string, cluster *config.Cluster) []*model.QueryStatus {
+	status := make([]*model.QueryStatus, 0)
+	add := func(query, server, expr string) {
+		status = append(status, &model.QueryStatus{
+			Cluster:    id,
+			Query:      query,
+			Expr:       expr,
+			Prometheus: server,
+			Skipped:    true,
+		})
+	}
+	for i, conn := range cluster.Connections {
+		add(fmt.Sprintf("serviceConnections[%d]", i), sourceKey(conn), conn.Query)
+		for j, m := range conn.Metrics {
+			add(fmt.Sprintf("serviceConnections[%d].metrics[%d]", i, j), sourceKey(conn), m.Query)
+		}
+	}
+	for i, noti := range cluster.NodeNotices {
+		add(fmt.Sprintf("serviceNotices[%d]", i), noti.PrometheusKey(), noti.Query)
+	}
+	for i, alert := range cluster.AlertNotices {
+		add(fmt.Sprintf("alertNotices[%d]", i), alertSourceKey(alert), alertExpr(alert))
+	}
+	for i, meta := range cluster.NodeMetadata {
+		add(fmt.Sprintf("serviceMetadata[%d]", i), meta.PrometheusKey(), meta.Query)
+	}
+	for _, child := range cluster.ChildLevel {
+		status = append(status, skippedQueryStatus(levelID(id, child.Cluster), child)...)
+	}
+	return status
+}
+
+func (g *generator) recordSamples(status *model.QueryStatus, series, dropped int) {
+	status.Series = series
+	status.DroppedSamples = dropped
+	g.metrics.querySeries.WithLabelValues(status.Cluster, status.Query, status.Prometheus).Set(float64(series))
+	if dropped > 0 {
+		g.metrics.droppedSamples.WithLabelValues(status.Cluster, status.Query, status.Prometheus).Add(float64(dropped))
+	}
+}
+
+// dataSource returns the data source of the connection, or nil if its type
+// is unknown.
+func (g *generator) dataSource(conn *config.Connection) DataSource {
+	if conn.IsPrometheus() {
+		return &promSource{querier: g.querier}
+	}
+	return g.sources[conn.Type]
+}
+
+// retryBackOff returns the backoff between the retries of a query with policy.
+func retryBackOff(policy config.QueryPolicy) backoff.BackOff {
+	// WithMaxRetries treats zero as unlimited retries, so no retry is a StopBackOff.
+	if policy.Retries <= 0 {
+		return &backoff.StopBackOff{}
+	}
+	eb := backoff.NewExponentialBackOff()
+	eb.InitialInterval = DefaultRetryBackoff
+	if policy.RetryBackoff > 0 {
+		eb.InitialInterval = time.Duration(policy.RetryBackoff)
+	}
+	eb.MaxElapsedTime = 0
+	return backoff.WithMaxRetries(eb, uint64(policy.Retries))
+}
+
+// query runs fetch for the query of status with the retries and the timeout
+// of the policy. When it still fails, the failure is recorded and handled by
+// policy.OnError: a nil result without error means the result should be
+// skipped, and a reused result is older than ts.
+func (g *generator) query(ctx context.Context, status *model.QueryStatus, policy config.QueryPolicy, ts time.Time, fetch func(context.Context) (prommodel.Value, error)) (*queryResult, error) {
+	cluster, server, query := status.Cluster, status.Prometheus, status.Expr
+	logger := g.logger.With(
+		zap.String("cluster", cluster),
+		zap.String("prometheus", server),
+		zap.String("query", query))
+
+	var value prommodel.Value
+	op := func() error {
+		qctx := withQueryPolicy(ctx, policy)
+		if policy.Timeout > 0 {
+			var cancel context.CancelFunc
+			qctx, cancel = context.WithTimeout(qctx, time.Duration(policy.Timeout))
+			defer cancel()
+		}
+		v, err := fetch(qctx)
+		if err != nil {
+			return err
+		}
+		value = v
+		return nil
+	}
+
+	cb := backoff.WithContext(retryBackOff(policy), ctx)
+
+	start := time.Now()
+	err := backoff.RetryNotify(op, cb, func(err error, next time.Duration) {
+		logger.Warn("Failed to send prom query, retrying", zap.Error(err), zap.Duration("next", next))
+	})
+	status.DurationSeconds = time.Since(start).Seconds()
+	g.metrics.queryLatency.WithLabelValues(cluster, status.Query, server).Observe(status.DurationSeconds)
+	key := resultKey(server, query)
+	if err == nil {
+		result := &queryResult{
+			value:     value,
+			timestamp: ts,
+		}
+		g.setResult(key, result)
+		return result, nil
+	}
+
+	status.Error = err.Error()
+	g.metrics.queryFailures.WithLabelValues(cluster, status.Query, server).Inc()
+
+	onError := policy.OnError
+	if onError == "" {
+		onError = config.DefaultOnError
+	}
+	logger.Error("Failed to send prom query",
+		zap.Error(err),
+		zap.String("onError", string(onError)))
+
+	g.mtx.Lock()
+	g.failedQueries = append(g.failedQueries, &model.FailedQuery{
+		Cluster:    cluster,
+		Prometheus: server,
+		Query:      query,
+		Error:      err.Error(),
+		OnError:    string(onError),
+	})
+	g.mtx.Unlock()
+
+	switch onError {
+	case config.OnErrorReuseLast:
+		last, ok := g.lastResults[key]
+		if !ok {
+			logger.Warn("No previous result to reuse")
+			return nil, nil
+		}
+		if staleness := last.staleness(ts); staleness > g.stalenessWindow {
+			logger.Warn("Previous result is too stale to reuse", zap.Duration("staleness", staleness))
+			return nil, nil
+		}
+		g.setResult(key, last)
+		return last, nil
+	case config.OnErrorFailSnapshot:
+		return nil, fmt.Errorf("query of cluster %q to %s failed: %v", cluster, server, err)
+	}
+	return nil, nil
+}
+
+func (g *generator) setResult(key string, result *queryResult) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if g.results == nil {
+		g.results = make(map[string]*queryResult)
+	}
+	g.results[key] = result
+}
+
+func resultKey(server, query string) string {
+	return server + "\x00" + query
+}
+
+// queryConnectionMetric sends the extra metric query of the connection
+// whose id is given and returns its values by connection key. Samples and
+// aggregated values which are NaN or infinite, e.g. from histogram_quantile
+// without requests, are dropped since they can not be encoded in JSON.
+func (g *generator) queryConnectionMetric(ctx context.Context, cluster, id string, conn *config.Connection, m *config.ConnectionMetric, ts time.Time) (map[string]float64, error) {
+	status := g.newQueryStatus(cluster, id, sourceKey(conn), m.Query)
+	result, err := g.query(ctx, status, conn.QueryPolicy, ts, func(ctx context.Context) (prommodel.Value, error) {
+		return g.querier.Query(ctx, conn.PrometheusKey(), m.Query, ts)
+	})
+	if err != nil || result == nil {
+		return nil, err
+	}
+	vector, ok := result.value.(prommodel.Vector)
+	if !ok {
+		g.logger.Info("Unexpected type", zap.Any("value", result.value))
+		return nil, nil
+	}
+
+	aggs := make(map[string]*aggregation)
+	dropped := 0
+	for _, s := range vector {
+		if !isFinite(float64(s.Value)) {
+			dropped++
+			continue
+		}
+		source, err := extractNodeName(s, conn.Source)
+		if err != nil {
+			dropped++
+			continue
+		}
+		target, err := extractNodeName(s, conn.Target)
+		if err != nil {
+			dropped++
+			continue
+		}
+		key := connectionKey(source, target)
+		if _, ok := aggs[key]; !ok {
+			aggs[key] = &aggregation{}
+		}
+		aggs[key].add(float64(s.Value))
+	}
+	g.recordSamples(status, len(vector), dropped)
+
+	values := make(map[string]float64, len(aggs))
+	for key, agg := range aggs {
+		if v := agg.value(m.Aggregation); isFinite(v) {
+			values[key] = v
+		}
+	}
+	return values, nil
+}
+
+type aggregation struct {
+	sum, min, max float64
+	count         int
+}
+
+func (a *aggregation) add(v float64) {
+	if a.count == 0 || v < a.min {
+		a.min = v
+	}
+	if a.count == 0 || v > a.max {
+		a.max = v
+	}
+	a.sum += v
+	a.count++
+}
+
+// isFinite reports whether v is neither NaN nor infinite.
+func isFinite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+func (a *aggregation) value(op string) float64 {
+	switch op {
+	case config.AggregationAvg:
+		return a.sum / float64(a.count)
+	case config.AggregationMax:
+		return a.max
+	case config.AggregationMin:
+		return a.min
+	}
+	return a.sum
+}
+
+// generateConnections returns the connections generated from vector and the
+// number of samples dropped because their node names could not be determined.
+// metricValues are the values of the extra metrics by connection key.
+func (g *generator) generateConnections(vector prommodel.Vector, conn *config.Connection, metricValues map[string]map[string]float64) ([]*model.Connection, int) {
 	type metrics struct {
 		Source  string
 		Target  string
@@ -217,11 +753,13 @@ func (g *generator) generateConnections(vector prommodel.Vector, conn *config.Co
 		Warning float64
 	}
 	metricMap := make(map[string]*metrics)
+	dropped := 0
 
 	for _, s := range vector {
 		source, err := extractNodeName(s, conn.Source)
 		if err != nil {
-			g.logger.Warn("Could not determine source node",
+			dropped++
+			g.logger.Debug("Could not determine source node",
 				zap.Error(err),
 				zap.Any("source", conn.Source),
 				zap.Any("sample", s))
@@ -230,14 +768,15 @@ func (g *generator) generateConnections(vector prommodel.Vector, conn *config.Co
 
 		target, err := extractNodeName(s, conn.Target)
 		if err != nil {
-			g.logger.Warn("Could not determine target node",
+			dropped++
+			g.logger.Debug("Could not determine target node",
 				zap.Error(err),
 				zap.Any("target", conn.Target), zap.Error(err),
 				zap.Any("sample", s))
 			continue
 		}
 
-		key := fmt.Sprintf("%s/%s", source, target)
+		key := connectionKey(source, target)
 		m, ok := metricMap[key]
 		if !ok {
 			m = &metrics{
@@ -275,12 +814,13 @@ func (g *generator) generateConnections(vector prommodel.Vector, conn *config.Co
 	}
 
 	connections := make([]*model.Connection, 0, len(metricMap))
-	for _, m := range metricMap {
+	for key, m := range metricMap {
 		vconn := &model.Connection{
 			Source: m.Source,
 			Target: m.Target,
 			Metadata: &model.Metadata{
 				Streaming: 1,
+				Metrics:   metricValues[key],
 			},
 			Metrics: &model.Metrics{
 				Normal:  m.Normal,
@@ -298,6 +838,13 @@ func (g *generator) generateConnections(vector prommodel.Vector, conn *config.Co
 			case "warning":
 				rate = m.Warning / m.All
 			}
+			if notice.Metric != "" {
+				value, ok := metricValues[key][notice.Metric]
+				if !ok {
+					continue
+				}
+				rate = value
+			}
 
 			severity := -1
 			switch {
@@ -345,11 +892,14 @@ func (g *generator) generateConnections(vector prommodel.Vector, conn *config.Co
 
 		connections = append(connections, vconn)
 	}
-	return connections
+	return connections, dropped
 }
 
-func (g *generator) generateNodeNotices(vector prommodel.Vector, noti *config.NodeNotice) map[string][]*model.Notice {
+// generateNodeNotices returns the notices generated from vector by node and
+// the number of samples dropped because their node names could not be determined.
+func (g *generator) generateNodeNotices(vector prommodel.Vector, noti *config.NodeNotice) (map[string][]*model.Notice, int) {
 	notices := make(map[string][]*model.Notice)
+	dropped := 0
 	for _, s := range vector {
 		logger := g.logger.With(
 			zap.Any("noti", noti),
@@ -357,7 +907,8 @@ func (g *generator) generateNodeNotices(vector prommodel.Vector, noti *config.No
 
 		node, err := extractNodeName(s, noti.Service)
 		if err != nil {
-			logger.Warn("Could not determine node", zap.Error(err))
+			dropped++
+			logger.Debug("Could not determine node", zap.Error(err))
 			continue
 		}
 
@@ -409,7 +960,75 @@ func (g *generator) generateNodeNotices(vector prommodel.Vector, noti *config.No
 			Severity: severity,
 		})
 	}
-	return notices
+	return notices, dropped
+}
+
+// nodeMetadata is the metadata of a node generated from the samples of a
+// service metadata query.
+type nodeMetadata struct {
+	labels  map[string]string
+	metrics map[string]float64
+}
+
+func (m *nodeMetadata) apply(node *model.Node) {
+	if node.Metadata == nil {
+		node.Metadata = &model.Metadata{}
+	}
+	if len(m.labels) > 0 && node.Metadata.Labels == nil {
+		node.Metadata.Labels = make(map[string]string, len(m.labels))
+	}
+	for k, v := range m.labels {
+		node.Metadata.Labels[k] = v
+	}
+	if len(m.metrics) > 0 && node.Metadata.Metrics == nil {
+		node.Metadata.Metrics = make(map[string]float64, len(m.metrics))
+	}
+	for k, v := range m.metrics {
+		node.Metadata.Metrics[k] = v
+	}
+}
+
+// generateNodeMetadata returns the metadata generated from vector by node and
+// the number of samples dropped because their node names could not be determined.
+// When several samples are mapped to a node, the non-empty label values of the
+// last one are kept and their values are combined by the aggregation.
+func (g *generator) generateNodeMetadata(vector prommodel.Vector, meta *config.NodeMeta) (map[string]*nodeMetadata, int) {
+	metadata := make(map[string]*nodeMetadata)
+	aggs := make(map[string]*aggregation)
+	dropped := 0
+	for _, s := range vector {
+		node, err := extractNodeName(s, meta.Service)
+		if err != nil {
+			dropped++
+			g.logger.Debug("Could not determine node of metadata", zap.Any("sample", s), zap.Error(err))
+			continue
+		}
+
+		m, ok := metadata[node]
+		if !ok {
+			m = &nodeMetadata{labels: make(map[string]string, len(meta.Labels))}
+			metadata[node] = m
+		}
+		for _, l := range meta.Labels {
+			if v := s.Metric[prommodel.LabelName(l)]; v != "" {
+				m.labels[l] = string(v)
+			}
+		}
+		// NaN and infinite values, which can not be encoded in JSON, are
+		// skipped while the labels of their samples are still used.
+		if meta.Name != "" && isFinite(float64(s.Value)) {
+			if _, ok := aggs[node]; !ok {
+				aggs[node] = &aggregation{}
+			}
+			aggs[node].add(float64(s.Value))
+		}
+	}
+	for node, agg := range aggs {
+		if v := agg.value(meta.Aggregation); isFinite(v) {
+			metadata[node].metrics = map[string]float64{meta.Name: v}
+		}
+	}
+	return metadata, dropped
 }
 
 func extractNodeName(sample *prommodel.Sample, mapping *config.NodeMapping) (string, error) {
@@ -457,6 +1076,28 @@ func calculateMaxVolume(nodes []*model.Node, connections []*model.Connection, ma
 	return float64(max) / maxVolumeRate
 }
 
+// markStaleConnection marks a connection generated from a reused result so
+// that it is dimmed in the UI instead of disappearing.
+func markStaleConnection(conn *model.Connection, staleness time.Duration, link string) {
+	conn.Stale = true
+	conn.Class = config.StaleClass.Name
+	conn.Notices = append(conn.Notices, newStaleNotice(staleness, link))
+}
+
+func markStaleNode(node *model.Node, staleness time.Duration) {
+	node.Stale = true
+	node.Notices = append(node.Notices, newStaleNotice(staleness, ""))
+}
+
+func newStaleNotice(staleness time.Duration, link string) *model.Notice {
+	return &model.Notice{
+		Title:    "Stale data",
+		Subtitle: fmt.Sprintf("Query failed, showing data from %s ago", staleness.Round(time.Second)),
+		Link:     link,
+		Severity: 1,
+	}
+}
+
 func newServiceNode(name string) *model.Node {
 	return &model.Node{
 		Name:     name,
@@ -1 +1,417 @@
 package retrieval
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nghialv/promviz/config"
+	"github.com/nghialv/promviz/model"
+	prometheus "github.com/prometheus/client_golang/api/prometheus/v1"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeQuerier returns values by query and fails the first failures[query] calls.
+type fakeQuerier struct {
+	mtx      sync.Mutex
+	values   map[string]prommodel.Value
+	failures map[string]int
+	calls    map[string]int
+	alerts   []prometheus.Alert
+}
+
+func (f *fakeQuerier) Query(ctx context.Context, server, query string, ts time.Time) (prommodel.Value, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.calls == nil {
+		f.calls = make(map[string]int)
+	}
+	f.calls[query]++
+	if f.calls[query] <= f.failures[query] {
+		return nil, errors.New("unavailable")
+	}
+	return f.values[query], nil
+}
+
+func (f *fakeQuerier) QueryRange(ctx context.Context, server, query string, r prometheus.Range) (prommodel.Value, error) {
+	return nil, errors.New("not supported")
+}
+
+func (f *fakeQuerier) Alerts(ctx context.Context, server string) ([]prometheus.Alert, error) {
+	return f.alerts, nil
+}
+
+func (f *fakeQuerier) Stop() error {
+	return nil
+}
+
+func newTestConnection(query string, policy config.QueryPolicy) *config.Connection {
+	return &config.Connection{
+		Query:         query,
+		PrometheusURL: "http://prometheus",
+		Source:        &config.NodeMapping{Label: "source", Regex: config.MustNewRegexp("(.*)"), Replacement: "$1"},
+		Target:        &config.NodeMapping{Label: "target", Regex: config.MustNewRegexp("(.*)"), Replacement: "$1"},
+		QueryPolicy:   policy,
+	}
+}
+
+func newTestVector(source, target string) prommodel.Vector {
+	return prommodel.Vector{
+		&prommodel.Sample{
+			Metric: prommodel.Metric{"source": prommodel.LabelValue(source), "target": prommodel.LabelValue(target)},
+			Value:  1,
+		},
+	}
+}
+
+func TestGeneratorQueryPolicy(t *testing.T) {
+	DefaultRetryBackoff = time.Millisecond
+	cfg := &config.Config{
+		ClusterLevel: []*config.Cluster{
+			{
+				Cluster: "cluster-1",
+				Connections: []*config.Connection{
+					newTestConnection("retried", config.QueryPolicy{Retries: 2}),
+					newTestConnection("skipped", config.QueryPolicy{OnError: config.OnErrorSkip}),
+					// Failed queries reuse their last result by default.
+					newTestConnection("reused", config.QueryPolicy{}),
+				},
+			},
+		},
+	}
+	q := &fakeQuerier{
+		values: map[string]prommodel.Value{
+			"retried": append(newTestVector("a", "b"), &prommodel.Sample{Metric: prommodel.Metric{"target": "b"}}),
+			"skipped": newTestVector("b", "c"),
+			"reused":  newTestVector("c", "d"),
+		},
+		failures: map[string]int{
+			"retried": 2,
+			"skipped": 1,
+			"reused":  1,
+		},
+	}
+
+	ts := time.Now()
+	g := &generator{
+		logger:  zap.NewNop(),
+		metrics: newRetrieverMetrics(nil),
+		cfg:     cfg,
+		querier: q,
+		lastResults: map[string]*queryResult{
+			resultKey("http://prometheus", "reused"): {
+				value:     newTestVector("c", "e"),
+				timestamp: ts.Add(-30 * time.Second),
+			},
+		},
+		stalenessWindow: time.Minute,
+	}
+	set, err := g.generateNodeConnectionSet(context.Background(), "cluster-1", cfg.ClusterLevel[0].Connections, nil, nil, nil, ts, newServiceNode)
+	require.NoError(t, err)
+
+	conns := make(map[string]string)
+	for _, c := range set.Connections {
+		conns[c.Source] = c.Target
+		assert.Equal(t, c.Source == "c", c.Stale)
+	}
+	assert.Equal(t, map[string]string{"a": "b", "c": "e"}, conns)
+	for _, n := range set.Nodes {
+		assert.Equal(t, n.Name == "c" || n.Name == "e", n.Stale, n.Name)
+	}
+
+	status := make(map[string]*model.QueryStatus)
+	for _, s := range g.queryStatus {
+		status[s.Query] = s
+	}
+	require.Len(t, status, 3)
+	assert.Equal(t, "retried", status["serviceConnections[0]"].Expr)
+	assert.Equal(t, 2, status["serviceConnections[0]"].Series)
+	assert.Equal(t, 1, status["serviceConnections[0]"].DroppedSamples)
+	assert.Empty(t, status["serviceConnections[0]"].Error)
+	assert.Equal(t, "unavailable", status["serviceConnections[1]"].Error)
+	assert.Equal(t, 3, q.calls["retried"])
+	assert.Len(t, g.results, 2)
+
+	failed := make(map[string]string)
+	for _, f := range g.failedQueries {
+		assert.Equal(t, "cluster-1", f.Cluster)
+		failed[f.Query] = f.OnError
+	}
+	assert.Equal(t, map[string]string{"skipped": "skip", "reused": "reuseLast"}, failed)
+
+	// The previous result is not reused once it is older than the staleness window.
+	q.calls = nil
+	g.lastResults, g.results, g.failedQueries = g.results, nil, nil
+	g.stalenessWindow = 10 * time.Second
+	set, err = g.generateNodeConnectionSet(context.Background(), "cluster-1", cfg.ClusterLevel[0].Connections, nil, nil, nil, ts.Add(time.Minute), newServiceNode)
+	require.NoError(t, err)
+	assert.Len(t, set.Connections, 1)
+
+	cfg.ClusterLevel[0].Connections[1].OnError = config.OnErrorFailSnapshot
+	q.calls = nil
+	q.failures = map[string]int{"skipped": 1}
+	g = &generator{
+		logger:  zap.NewNop(),
+		metrics: newRetrieverMetrics(nil),
+		cfg:     cfg,
+		querier: q,
+	}
+	_, err = g.generateSnapshot(context.Background(), time.Now())
+	require.Error(t, err)
+	assert.Equal(t, []*model.FailedQuery{
+		{Cluster: "cluster-1", Prometheus: "http://prometheus", Query: "skipped", Error: "unavailable", OnError: "failSnapshot"},
+	}, g.failedQueries)
+}
+
+func TestGeneratorConnectionMetrics(t *testing.T) {
+	conn := newTestConnection("requests", config.QueryPolicy{})
+	conn.Metrics = []*config.ConnectionMetric{
+		{Name: "p99", Query: "latency", Aggregation: config.AggregationMax},
+		{Name: "bytes", Query: "bytes"},
+	}
+	conn.Notices = []*config.ConnectionNotice{
+		{Title: "p99 is {{.value}}", Metric: "p99", SeverityThreshold: config.SeverityThreshold{Warning: 0.5, Error: 1}},
+	}
+	sample := func(source, target string, value float64) *prommodel.Sample {
+		return &prommodel.Sample{
+			Metric: prommodel.Metric{"source": prommodel.LabelValue(source), "target": prommodel.LabelValue(target)},
+			Value:  prommodel.SampleValue(value),
+		}
+	}
+	q := &fakeQuerier{
+		values: map[string]prommodel.Value{
+			"requests": prommodel.Vector{sample("a", "b", 10), sample("b", "c", 5), sample("c", "d", 1)},
+			"latency":  prommodel.Vector{sample("a", "b", 0.2), sample("a", "b", 0.7), sample("b", "c", 0.1), sample("b", "c", math.NaN()), sample("c", "d", math.NaN()), sample("x", "y", 3)},
+			"bytes":    prommodel.Vector{sample("a", "b", 100), sample("a", "b", 50), sample("c", "d", math.Inf(1))},
+		},
+	}
+	g := &generator{
+		logger:  zap.NewNop(),
+		metrics: newRetrieverMetrics(nil),
+		querier: q,
+	}
+	set, err := g.generateNodeConnectionSet(context.Background(), "cluster-1", []*config.Connection{conn}, nil, nil, nil, time.Now(), newServiceNode)
+	require.NoError(t, err)
+
+	conns := make(map[string]*model.Connection)
+	for _, c := range set.Connections {
+		conns[c.Source+"/"+c.Target] = c
+	}
+	require.Len(t, conns, 3)
+	assert.Equal(t, map[string]float64{"p99": 0.7, "bytes": 150}, conns["a/b"].Metadata.Metrics)
+	assert.Equal(t, []*model.Notice{
+		{Title: "p99 is 0.70000", Link: conn.QueryLink(), Severity: 1},
+	}, conns["a/b"].Notices)
+	assert.Equal(t, map[string]float64{"p99": 0.1}, conns["b/c"].Metadata.Metrics)
+	assert.Empty(t, conns["b/c"].Notices)
+	// NaN and infinite values are dropped so that the graph can be encoded.
+	assert.Empty(t, conns["c/d"].Metadata.Metrics)
+	_, err = json.Marshal(set)
+	assert.NoError(t, err)
+
+	ids := make([]string, 0, len(g.queryStatus))
+	for _, s := range g.queryStatus {
+		ids = append(ids, s.Query)
+	}
+	assert.ElementsMatch(t, []string{"serviceConnections[0]", "serviceConnections[0].metrics[0]", "serviceConnections[0].metrics[1]"}, ids)
+}
+
+func TestGeneratorNodeMetadata(t *testing.T) {
+	service := &config.NodeMapping{Label: "service", Regex: config.MustNewRegexp("(.*)"), Replacement: "$1"}
+	sample := func(svc, team, version string, value float64) *prommodel.Sample {
+		return &prommodel.Sample{
+			Metric: prommodel.Metric{
+				"service": prommodel.LabelValue(svc),
+				"team":    prommodel.LabelValue(team),
+				"version": prommodel.LabelValue(version),
+			},
+			Value: prommodel.SampleValue(value),
+		}
+	}
+	q := &fakeQuerier{
+		values: map[string]prommodel.Value{
+			"requests": newTestVector("a", "b"),
+			"info":     prommodel.Vector{sample("a", "payments", "v1", 1), sample("b", "search", "v2", 1), sample("x", "other", "v1", 1)},
+			"replicas": prommodel.Vector{sample("a", "", "", 2), sample("a", "", "", 3), sample("b", "", "", math.NaN()), {Metric: prommodel.Metric{}, Value: 1}},
+		},
+	}
+	metadata := []*config.NodeMeta{
+		{Query: "info", PrometheusURL: "http://prometheus", Service: service, Labels: []string{"team", "version"}},
+		{Query: "replicas", PrometheusURL: "http://prometheus", Service: service, Name: "replicas"},
+	}
+	g := &generator{
+		logger:  zap.NewNop(),
+		metrics: newRetrieverMetrics(nil),
+		querier: q,
+	}
+	set, err := g.generateNodeConnectionSet(context.Background(), "cluster-1", []*config.Connection{newTestConnection("requests", config.QueryPolicy{})}, nil, nil, metadata, time.Now(), newServiceNode)
+	require.NoError(t, err)
+
+	nodes := make(map[string]*model.Node)
+	for _, n := range set.Nodes {
+		nodes[n.Name] = n
+	}
+	require.Len(t, nodes, 2)
+	assert.Equal(t, &model.Metadata{
+		Streaming: 1,
+		Labels:    map[string]string{"team": "payments", "version": "v1"},
+		Metrics:   map[string]float64{"replicas": 5},
+	}, nodes["a"].Metadata)
+	assert.Equal(t, &model.Metadata{
+		Streaming: 1,
+		Labels:    map[string]string{"team": "search", "version": "v2"},
+	}, nodes["b"].Metadata)
+	_, err = json.Marshal(set)
+	assert.NoError(t, err)
+
+	for _, s := range g.queryStatus {
+		if s.Query == "serviceMetadata[1]" {
+			assert.Equal(t, 4, s.Series)
+			assert.Equal(t, 1, s.DroppedSamples)
+		}
+	}
+}
+
+func TestGeneratorChildLevels(t *testing.T) {
+	cfg := &config.Config{
+		GlobalLevel: config.GlobalLevel{
+			Connections: []*config.Connection{newTestConnection("regions", config.QueryPolicy{})},
+		},
+		ClusterLevel: []*config.Cluster{
+			{
+				Cluster:     "eu",
+				Connections: []*config.Connection{newTestConnection("clusters", config.QueryPolicy{})},
+				ChildLevel: []*config.Cluster{
+					{
+						Cluster:     "cluster-1",
+						MaxVolume:   100,
+						Connections: []*config.Connection{newTestConnection("namespaces", config.QueryPolicy{})},
+						ChildLevel: []*config.Cluster{
+							{
+								Cluster:     "payments",
+								Renderer:    config.RendererFocused,
+								Connections: []*config.Connection{newTestConnection("services", config.QueryPolicy{})},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	g := &generator{
+		logger:  zap.NewNop(),
+		metrics: newRetrieverMetrics(nil),
+		cfg:     cfg,
+		querier: &fakeQuerier{
+			values: map[string]prommodel.Value{
+				"regions":    newTestVector("INTERNET", "eu"),
+				"clusters":   newTestVector("INTERNET", "cluster-1"),
+				"namespaces": newTestVector("ingress", "payments"),
+				"services":   newTestVector("api", "db"),
+			},
+		},
+	}
+	snapshot, err := g.generateSnapshot(context.Background(), time.Now())
+	require.NoError(t, err)
+
+	var graph model.VizceralGraph
+	require.NoError(t, json.Unmarshal([]byte(snapshot.GraphJSON), &graph))
+	assert.Equal(t, config.RendererGlobal, graph.Renderer)
+
+	find := func(nodes []*model.Node, name string) *model.Node {
+		for _, n := range nodes {
+			if n.Name == name {
+				return n
+			}
+		}
+		require.Failf(t, "node not found", "%s", name)
+		return nil
+	}
+	region := find(graph.Nodes, "eu")
+	assert.Equal(t, config.RendererRegion, region.Renderer)
+	cluster := find(region.Nodes, "cluster-1")
+	assert.Equal(t, config.RendererRegion, cluster.Renderer)
+	assert.Equal(t, float64(100), cluster.MaxVolume)
+	assert.Equal(t, config.RendererFocusedChild, find(region.Nodes, "INTERNET").Renderer)
+	namespace := find(cluster.Nodes, "payments")
+	assert.Equal(t, config.RendererFocused, namespace.Renderer)
+	assert.Empty(t, find(cluster.Nodes, "ingress").Nodes)
+	require.Len(t, namespace.Connections, 1)
+	assert.Equal(t, "api", namespace.Connections[0].Source)
+	assert.Equal(t, "db", namespace.Connections[0].Target)
+
+	clusters := make([]string, 0, len(g.queryStatus))
+	for _, s := range g.queryStatus {
+		clusters = append(clusters, s.Cluster)
+	}
+	assert.ElementsMatch(t, []string{"", "eu", "eu/cluster-1", "eu/cluster-1/payments"}, clusters)
+}
+
+func TestGeneratorGroups(t *testing.T) {
+	cfg := &config.Config{
+		GlobalLevel: config.GlobalLevel{
+			Connections: []*config.Connection{newTestConnection("clusters", config.QueryPolicy{})},
+		},
+		ClusterLevel: []*config.Cluster{
+			{
+				Cluster:     "cluster-1",
+				Connections: []*config.Connection{newTestConnection("namespaces", config.QueryPolicy{})},
+				Groups: []*config.NodeGroup{
+					{Regex: config.MustNewRegexp("^(payments|billing)$"), Replacement: "finance", DrillDown: true},
+				},
+				ChildLevel: []*config.Cluster{
+					{
+						Cluster:     "payments",
+						Connections: []*config.Connection{newTestConnection("services", config.QueryPolicy{})},
+					},
+				},
+			},
+		},
+	}
+	g := &generator{
+		logger:  zap.NewNop(),
+		metrics: newRetrieverMetrics(nil),
+		cfg:     cfg,
+		querier: &fakeQuerier{
+			values: map[string]prommodel.Value{
+				"clusters":   newTestVector("INTERNET", "cluster-1"),
+				"namespaces": append(newTestVector("ingress", "payments"), newTestVector("payments", "billing")...),
+				"services":   newTestVector("api", "db"),
+			},
+		},
+	}
+	snapshot, err := g.generateSnapshot(context.Background(), time.Now())
+	require.NoError(t, err)
+
+	var graph model.VizceralGraph
+	require.NoError(t, json.Unmarshal([]byte(snapshot.GraphJSON), &graph))
+	find := func(nodes []*model.Node, name string) *model.Node {
+		for _, n := range nodes {
+			if n.Name == name {
+				return n
+			}
+		}
+		require.Failf(t, "node not found", "%s", name)
+		return nil
+	}
+	cluster := find(graph.Nodes, "cluster-1")
+	require.Len(t, cluster.Nodes, 2)
+	group := find(cluster.Nodes, "finance")
+	require.Len(t, cluster.Connections, 1)
+	assert.Equal(t, "finance", cluster.Connections[0].Target)
+
+	require.Len(t, group.Nodes, 2)
+	payments := find(group.Nodes, "payments")
+	assert.Equal(t, config.RendererRegion, payments.Renderer)
+	require.Len(t, payments.Connections, 1)
+	assert.Equal(t, "db", payments.Connections[0].Target)
+	require.Len(t, group.Connections, 1)
+	assert.Equal(t, "billing", group.Connections[0].Target)
+}
@@ -0,0 +1,215 @@
+package retrieval
+
+import (
+	"github.com/nghialv/promviz/config"
+	"github.com/nghialv/promviz/model"
+)
+
+// groupNodes collapses the nodes of set matching one of the groups into a
+// node per group. The connections between the nodes of a group are dropped
+// and the connections between the same nodes after grouping are merged by
+// summing their metrics. A drill-down group node contains its nodes and the
+// connections between them.
+func groupNodes(set *model.NodeConnectionSet, groups []*config.NodeGroup) *model.NodeConnectionSet {
+	if len(groups) == 0 {
+		return set
+	}
+
+	groupOf := make(map[string]string)
+	ruleOf := make(map[string]*config.NodeGroup)
+	for _, n := range set.Nodes {
+		name, rule := nodeGroup(n, groups)
+		if rule == nil {
+			continue
+		}
+		groupOf[n.Name] = name
+		if _, ok := ruleOf[name]; !ok {
+			ruleOf[name] = rule
+		}
+	}
+	if len(groupOf) == 0 {
+		return set
+	}
+	// A node which is not grouped but has the name of a group joins it.
+	for _, n := range set.Nodes {
+		if _, ok := groupOf[n.Name]; !ok {
+			if _, ok := ruleOf[n.Name]; ok {
+				groupOf[n.Name] = n.Name
+			}
+		}
+	}
+
+	nodes := make([]*model.Node, 0, len(set.Nodes))
+	groupNodes := make(map[string]*model.Node, len(ruleOf))
+	members := make(map[string][]*model.Node, len(ruleOf))
+	for _, n := range set.Nodes {
+		name, ok := groupOf[n.Name]
+		if !ok {
+			nodes = append(nodes, n)
+			continue
+		}
+		gn, ok := groupNodes[name]
+		if !ok {
+			gn = newGroupNode(name, ruleOf[name])
+			groupNodes[name] = gn
+			nodes = append(nodes, gn)
+		}
+		gn.Notices = append(gn.Notices, n.Notices...)
+		gn.Stale = gn.Stale || n.Stale
+		members[name] = append(members[name], n)
+	}
+	for name, gn := range groupNodes {
+		gn.Metadata.Labels = commonLabels(members[name])
+		if ruleOf[name].DrillDown {
+			gn.Nodes = members[name]
+		}
+	}
+
+	outer := newConnectionMerger()
+	inner := make(map[string]*connectionMerger)
+	for _, c := range set.Connections {
+		source, sok := groupOf[c.Source]
+		target, tok := groupOf[c.Target]
+		if !sok {
+			source = c.Source
+		}
+		if !tok {
+			target = c.Target
+		}
+		if !sok || !tok || source != target {
+			outer.add(source, target, c)
+			continue
+		}
+		if !ruleOf[source].DrillDown {
+			continue
+		}
+		if _, ok := inner[source]; !ok {
+			inner[source] = newConnectionMerger()
+		}
+		inner[source].add(c.Source, c.Target, c)
+	}
+	for name, m := range inner {
+		groupNodes[name].Connections = m.connections
+	}
+
+	return &model.NodeConnectionSet{
+		Nodes:       nodes,
+		Connections: outer.connections,
+	}
+}
+
+// nodeGroup returns the name of the group of the node and the first of the
+// groups matching it, or nil if none matches.
+func nodeGroup(node *model.Node, groups []*config.NodeGroup) (string, *config.NodeGroup) {
+	for _, g := range groups {
+		value := node.Name
+		if g.Label != "" {
+			if node.Metadata == nil {
+				continue
+			}
+			v, ok := node.Metadata.Labels[g.Label]
+			if !ok || v == "" {
+				continue
+			}
+			value = v
+		}
+		indexes := g.Regex.FindStringSubmatchIndex(value)
+		if indexes == nil {
+			continue
+		}
+		name := string(g.Regex.ExpandString([]byte{}, g.Replacement, value, indexes))
+		if name == "" {
+			continue
+		}
+		return name, g
+	}
+	return "", nil
+}
+
+func newGroupNode(name string, group *config.NodeGroup) *model.Node {
+	node := newServiceNode(name)
+	node.Class = group.Class
+	if group.DrillDown {
+		node.Renderer = config.RendererRegion
+	}
+	return node
+}
+
+// commonLabels returns the metadata labels shared by all of the nodes, so
+// that a group node can still be filtered by them.
+func commonLabels(nodes []*model.Node) map[string]string {
+	var labels map[string]string
+	for i, n := range nodes {
+		if n.Metadata == nil || len(n.Metadata.Labels) == 0 {
+			return nil
+		}
+		if i == 0 {
+			labels = make(map[string]string, len(n.Metadata.Labels))
+			for k, v := range n.Metadata.Labels {
+				labels[k] = v
+			}
+			continue
+		}
+		for k, v := range labels {
+			if n.Metadata.Labels[k] != v {
+				delete(labels, k)
+			}
+		}
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+// connectionMerger merges the connections between the same source and target.
+type connectionMerger struct {
+	connections []*model.Connection
+	index       map[string]*model.Connection
+}
+
+func newConnectionMerger() *connectionMerger {
+	return &connectionMerger{
+		connections: make([]*model.Connection, 0),
+		index:       make(map[string]*model.Connection),
+	}
+}
+
+// add adds a copy of conn from source to target, or merges it into the
+// connection already added between them. The metrics are summed. The extra
+// metrics of merged connections, e.g. latencies, can not be summed and are dropped.
+func (m *connectionMerger) add(source, target string, conn *model.Connection) {
+	key := connectionKey(source, target)
+	merged, ok := m.index[key]
+	if !ok {
+		c := *conn
+		c.Source, c.Target = source, target
+		if conn.Metrics != nil {
+			metrics := *conn.Metrics
+			c.Metrics = &metrics
+		}
+		c.Notices = append(make([]*model.Notice, 0, len(conn.Notices)), conn.Notices...)
+		m.index[key] = &c
+		m.connections = append(m.connections, &c)
+		return
+	}
+
+	if conn.Metrics != nil {
+		if merged.Metrics == nil {
+			merged.Metrics = &model.Metrics{}
+		}
+		merged.Metrics.Danger += conn.Metrics.Danger
+		merged.Metrics.Warning += conn.Metrics.Warning
+		merged.Metrics.Normal += conn.Metrics.Normal
+	}
+	if merged.Metadata != nil && merged.Metadata.Metrics != nil {
+		metadata := *merged.Metadata
+		metadata.Metrics = nil
+		merged.Metadata = &metadata
+	}
+	if merged.Class != conn.Class {
+		merged.Class = ""
+	}
+	merged.Notices = append(merged.Notices, conn.Notices...)
+	merged.Stale = merged.Stale || conn.Stale
+}
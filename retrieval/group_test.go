@@ -0,0 +1,87 @@
+package retrieval
+
+import (
+	"testing"
+
+	"github.com/nghialv/promviz/config"
+	"github.com/nghialv/promviz/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupNodes(t *testing.T) {
+	node := func(name string, labels map[string]string) *model.Node {
+		n := newServiceNode(name)
+		n.Metadata.Labels = labels
+		return n
+	}
+	conn := func(source, target string, normal, danger float64) *model.Connection {
+		return &model.Connection{
+			Source:   source,
+			Target:   target,
+			Metadata: &model.Metadata{Streaming: 1, Metrics: map[string]float64{"p99": 0.5}},
+			Metrics:  &model.Metrics{Normal: normal, Danger: danger},
+		}
+	}
+	set := &model.NodeConnectionSet{
+		Nodes: []*model.Node{
+			node("INTERNET", nil),
+			node("payments-api", map[string]string{"namespace": "payments", "team": "core"}),
+			node("payments-db", map[string]string{"namespace": "payments", "team": "dba"}),
+			node("search-api", map[string]string{"namespace": "search"}),
+			node("search-indexer", map[string]string{"namespace": "search"}),
+			node("redis-1", nil),
+			node("redis-2", nil),
+		},
+		Connections: []*model.Connection{
+			conn("INTERNET", "payments-api", 10, 1),
+			conn("INTERNET", "search-api", 5, 0),
+			conn("payments-api", "payments-db", 8, 0),
+			conn("search-api", "search-indexer", 4, 0),
+			conn("payments-api", "redis-1", 3, 0),
+			conn("payments-db", "redis-2", 2, 1),
+			conn("search-api", "redis-1", 1, 0),
+		},
+	}
+	groups := []*config.NodeGroup{
+		{Regex: config.MustNewRegexp("^redis-.*$"), Replacement: "redis", Class: "cache"},
+		{Label: "namespace", Regex: config.MustNewRegexp("^(payments)$"), Replacement: "$1", DrillDown: true},
+		{Label: "namespace", Regex: config.MustNewRegexp("^(.+)$"), Replacement: "ns-$1"},
+	}
+
+	grouped := groupNodes(set, groups)
+
+	names := make([]string, 0, len(grouped.Nodes))
+	nodes := make(map[string]*model.Node)
+	for _, n := range grouped.Nodes {
+		names = append(names, n.Name)
+		nodes[n.Name] = n
+	}
+	assert.Equal(t, []string{"INTERNET", "payments", "ns-search", "redis"}, names)
+	assert.Equal(t, "cache", nodes["redis"].Class)
+	assert.Equal(t, config.RendererRegion, nodes["payments"].Renderer)
+	assert.Equal(t, config.RendererFocusedChild, nodes["ns-search"].Renderer)
+	assert.Equal(t, map[string]string{"namespace": "payments"}, nodes["payments"].Metadata.Labels)
+	assert.Empty(t, nodes["ns-search"].Nodes)
+
+	conns := make(map[string]*model.Connection)
+	for _, c := range grouped.Connections {
+		conns[connectionKey(c.Source, c.Target)] = c
+	}
+	require.Len(t, conns, 4)
+	assert.Equal(t, &model.Metrics{Normal: 10, Danger: 1}, conns["INTERNET/payments"].Metrics)
+	assert.Equal(t, map[string]float64{"p99": 0.5}, conns["INTERNET/payments"].Metadata.Metrics)
+	assert.Equal(t, &model.Metrics{Normal: 5, Danger: 1}, conns["payments/redis"].Metrics)
+	assert.Nil(t, conns["payments/redis"].Metadata.Metrics)
+	assert.Equal(t, &model.Metrics{Normal: 1}, conns["ns-search/redis"].Metrics)
+	assert.Contains(t, conns, "INTERNET/ns-search")
+
+	require.Len(t, nodes["payments"].Nodes, 2)
+	assert.Equal(t, "payments-api", nodes["payments"].Nodes[0].Name)
+	require.Len(t, nodes["payments"].Connections, 1)
+	assert.Equal(t, "payments-db", nodes["payments"].Connections[0].Target)
+
+	// The connections of the original set are not modified.
+	assert.Equal(t, &model.Metrics{Normal: 3}, set.Connections[4].Metrics)
+	assert.Equal(t, map[string]float64{"p99": 0.5}, set.Connections[4].Metadata.Metrics)
+}
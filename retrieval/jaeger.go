@@ -0,0 +1,123 @@
+package retrieval
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nghialv/promviz/config"
+	prommodel "github.com/prometheus/common/model"
+	"go.uber.org/zap"
+)
+
+// DefaultDependencyLookback is the window of the dependency links fetched by
+// jaeger connections without lookback.
+var DefaultDependencyLookback = time.Hour
+
+const (
+	// dependencyStatusLabel is set to dependencyStatusOK or dependencyStatusError
+	// on the samples of jaeger connections, so their errors can be split by
+	// a status with dangerRegex: error.
+	dependencyStatusLabel = "status"
+	dependencyStatusOK    = "ok"
+	dependencyStatusError = "error"
+)
+
+// dependencyLink is an entry of the response of /api/dependencies.
+// ErrorCount is only returned by some storage backends.
+type dependencyLink struct {
+	Parent     string `json:"parent"`
+	Child      string `json:"child"`
+	CallCount  uint64 `json:"callCount"`
+	ErrorCount uint64 `json:"errorCount"`
+}
+
+type dependenciesResponse struct {
+	Data   []*dependencyLink `json:"data"`
+	Errors []struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	} `json:"errors"`
+}
+
+// jaegerSource fetches the dependency links between services from the
+// /api/dependencies endpoint of the jaeger query service. Each link becomes
+// samples labelled with its parent as source and its child as target whose
+// values are the calls per second over the lookback, split by status.
+type jaegerSource struct {
+	client *http.Client
+}
+
+func newJaegerSource(logger *zap.Logger, cfg *config.Config) (DataSource, error) {
+	return &jaegerSource{
+		client: &http.Client{},
+	}, nil
+}
+
+func (s *jaegerSource) Query(ctx context.Context, conn *config.Connection, ts time.Time) (prommodel.Vector, error) {
+	lookback := time.Duration(conn.Lookback)
+	if lookback <= 0 {
+		lookback = DefaultDependencyLookback
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(conn.URL, "/") + "/api/dependencies")
+	if err != nil {
+		return nil, err
+	}
+	params := u.Query()
+	params.Set("endTs", strconv.FormatInt(ts.UnixNano()/int64(time.Millisecond), 10))
+	params.Set("lookback", strconv.FormatInt(int64(lookback/time.Millisecond), 10))
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("Unexpected status %s from %s", resp.Status, conn.URL)
+	}
+	var deps dependenciesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&deps); err != nil {
+		return nil, fmt.Errorf("Failed to decode dependencies from %s: %v", conn.URL, err)
+	}
+	if len(deps.Errors) > 0 {
+		return nil, fmt.Errorf("Failed to get dependencies from %s: %s", conn.URL, deps.Errors[0].Msg)
+	}
+
+	seconds := lookback.Seconds()
+	vector := make(prommodel.Vector, 0, len(deps.Data))
+	sample := func(link *dependencyLink, status string, count uint64) {
+		vector = append(vector, &prommodel.Sample{
+			Metric: prommodel.Metric{
+				"source":              prommodel.LabelValue(link.Parent),
+				"target":              prommodel.LabelValue(link.Child),
+				dependencyStatusLabel: prommodel.LabelValue(status),
+			},
+			Value:     prommodel.SampleValue(float64(count) / seconds),
+			Timestamp: prommodel.TimeFromUnixNano(ts.UnixNano()),
+		})
+	}
+	for _, link := range deps.Data {
+		failed := link.ErrorCount
+		if failed > link.CallCount {
+			failed = link.CallCount
+		}
+		sample(link, dependencyStatusOK, link.CallCount-failed)
+		if failed > 0 {
+			sample(link, dependencyStatusError, failed)
+		}
+	}
+	return vector, nil
+}
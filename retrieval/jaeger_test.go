@@ -0,0 +1,66 @@
+package retrieval
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nghialv/promviz/config"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestJaegerSource(t *testing.T) {
+	dangerRegex := config.MustNewRegexp("error")
+	var endTs, lookback string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/jaeger/api/dependencies" {
+			http.NotFound(w, req)
+			return
+		}
+		endTs = req.URL.Query().Get("endTs")
+		lookback = req.URL.Query().Get("lookback")
+		http.ServeFile(w, req, "testdata/jaeger_dependencies.json")
+	}))
+	defer srv.Close()
+
+	conn := &config.Connection{
+		Type:     config.ConnectionTypeJaeger,
+		URL:      srv.URL + "/jaeger/",
+		Lookback: prommodel.Duration(time.Minute),
+		Source:   &config.NodeMapping{Label: "source", Regex: config.MustNewRegexp("(.*)"), Replacement: "$1"},
+		Target:   &config.NodeMapping{Label: "target", Regex: config.MustNewRegexp("(redis|[^-]*).*"), Replacement: "$1"},
+		Status:   &config.Status{Label: "status", DangerRegex: &dangerRegex},
+	}
+	assert.Equal(t, srv.URL+"/jaeger/dependencies", conn.QueryLink())
+
+	sources, err := newDataSources(zap.NewNop(), &config.Config{
+		GlobalLevel: config.GlobalLevel{Connections: []*config.Connection{conn}},
+	})
+	require.NoError(t, err)
+	g := &generator{
+		logger:  zap.NewNop(),
+		metrics: newRetrieverMetrics(nil),
+		sources: sources,
+	}
+	ts := time.Unix(1600000000, 0)
+	set, err := g.generateNodeConnectionSet(context.Background(), "", []*config.Connection{conn}, nil, nil, nil, ts, newClusterNode)
+	require.NoError(t, err)
+	assert.Equal(t, "1600000000000", endTs)
+	assert.Equal(t, "60000", lookback)
+
+	metrics := make(map[string]*struct{ normal, danger float64 })
+	for _, c := range set.Connections {
+		metrics[c.Source+"/"+c.Target] = &struct{ normal, danger float64 }{c.Metrics.Normal, c.Metrics.Danger}
+	}
+	assert.Equal(t, map[string]*struct{ normal, danger float64 }{
+		"frontend/customer": {6, 0},
+		"frontend/driver":   {11.4, 0.6},
+		"driver/redis":      {0, 60},
+	}, metrics)
+	assert.Len(t, set.Nodes, 4)
+}
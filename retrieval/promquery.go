@@ -2,79 +2,712 @@ package retrieval
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
+	"net/http"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/cenkalti/backoff"
 	"github.com/nghialv/promviz/config"
+	"github.com/nghialv/promviz/model"
 	"github.com/prometheus/client_golang/api"
 	prometheus "github.com/prometheus/client_golang/api/prometheus/v1"
+	promconfig "github.com/prometheus/common/config"
 	prommodel "github.com/prometheus/common/model"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
 )
 
 type querier interface {
 	Query(context.Context, string, string, time.Time) (prommodel.Value, error)
+	QueryRange(context.Context, string, string, prometheus.Range) (prommodel.Value, error)
+	Alerts(context.Context, string) ([]prometheus.Alert, error)
 	Stop() error
 }
 
 type promClient struct {
+	name     string
+	replicas []*replica
+	strategy config.ReplicaStrategy
+
+	// inFlight limits the number of concurrent queries and limiter the
+	// rate of queries. Both are nil when the server has no limit.
+	inFlight chan struct{}
+	limiter  *rate.Limiter
+}
+
+// replica is one address of a prometheus server. It is unhealthy while its
+// latest query failed.
+type replica struct {
 	addr     string
-	client   api.Client
 	queryAPI prometheus.API
+
+	mtx       sync.Mutex
+	healthy   bool
+	lastCheck time.Time
+	lastError string
 }
 
 type prompool struct {
+	logger  *zap.Logger
+	metrics *retrieverMetrics
 	clients map[string]*promClient
 	mtx     sync.Mutex
 }
 
-func newQuerier(logger *zap.Logger, cfg *config.Config) (*prompool, error) {
-	addrs := make(map[string]struct{}, 0)
+func newQuerier(logger *zap.Logger, cfg *config.Config, metrics *retrieverMetrics) (*prompool, error) {
+	servers := make(map[string]*config.PrometheusServer, len(cfg.PrometheusServers))
+	for _, s := range cfg.PrometheusServers {
+		servers[s.Name] = s
+	}
+	addServer := func(key, addr string) {
+		if _, ok := servers[key]; ok || key == "" {
+			return
+		}
+		s := config.DefaultPrometheusServer
+		s.Name = key
+		s.URL = addr
+		servers[key] = &s
+	}
+
 	for _, conn := range cfg.GlobalLevel.Connections {
-		addrs[conn.PrometheusURL] = struct{}{}
+		addServer(conn.PrometheusKey(), conn.PrometheusURL)
 	}
-	for _, cluster := range cfg.ClusterLevel {
+	for _, an := range cfg.GlobalLevel.AlertNotices {
+		addServer(an.PrometheusKey(), an.PrometheusURL)
+	}
+	addCluster := func(path string, cluster *config.Cluster) {
 		for _, conn := range cluster.Connections {
-			addrs[conn.PrometheusURL] = struct{}{}
+			addServer(conn.PrometheusKey(), conn.PrometheusURL)
 		}
 		for _, notice := range cluster.NodeNotices {
-			addrs[notice.PrometheusURL] = struct{}{}
+			addServer(notice.PrometheusKey(), notice.PrometheusURL)
+		}
+		for _, an := range cluster.AlertNotices {
+			addServer(an.PrometheusKey(), an.PrometheusURL)
 		}
+		for _, meta := range cluster.NodeMetadata {
+			addServer(meta.PrometheusKey(), meta.PrometheusURL)
+		}
+	}
+	for _, cluster := range cfg.ClusterLevel {
+		cluster.Walk("", addCluster)
+	}
+	for _, ct := range cfg.ClusterTemplates {
+		addServer(ct.Discovery.PrometheusKey(), ct.Discovery.PrometheusURL)
+		ct.Template.Walk("", addCluster)
 	}
-	delete(addrs, "")
 
 	pq := &prompool{
-		clients: make(map[string]*promClient, len(addrs)),
+		logger:  logger,
+		metrics: metrics,
+		clients: make(map[string]*promClient, len(servers)),
 	}
 
-	for addr := range addrs {
-		c, err := api.NewClient(api.Config{Address: addr})
+	for key, s := range servers {
+		rt, err := promconfig.NewRoundTripperFromConfig(s.HTTPClientConfig, s.Name)
 		if err != nil {
 			return nil, err
 		}
-		a := prometheus.NewAPI(c)
-		pq.clients[addr] = &promClient{
-			addr:     addr,
-			client:   c,
-			queryAPI: a,
+		if len(s.Headers) > 0 {
+			rt = &headersRoundTripper{
+				headers: s.Headers,
+				rt:      rt,
+			}
+		}
+		pc := &promClient{
+			name:     key,
+			strategy: s.ReplicaStrategy,
+		}
+		for _, addr := range s.URLs() {
+			c, err := api.NewClient(api.Config{
+				Address:      addr,
+				RoundTripper: rt,
+			})
+			if err != nil {
+				return nil, err
+			}
+			pc.replicas = append(pc.replicas, &replica{
+				addr:     addr,
+				queryAPI: prometheus.NewAPI(c),
+				healthy:  true,
+			})
 		}
+		if s.MaxConcurrentQueries > 0 {
+			pc.inFlight = make(chan struct{}, s.MaxConcurrentQueries)
+		}
+		if s.QueryRateLimit > 0 {
+			pc.limiter = rate.NewLimiter(rate.Limit(s.QueryRateLimit), int(math.Ceil(s.QueryRateLimit)))
+		}
+		pq.clients[key] = pc
 	}
 	return pq, nil
 }
 
-func (pp *prompool) Query(ctx context.Context, addr string, query string, ts time.Time) (prommodel.Value, error) {
+func (pp *prompool) Query(ctx context.Context, server string, query string, ts time.Time) (prommodel.Value, error) {
+	pp.mtx.Lock()
+	client, _ := pp.clients[server]
+	pp.mtx.Unlock()
+
+	if client == nil {
+		return nil, fmt.Errorf("Could not send a query to unknown prometheus server (server=%s)", server)
+	}
+	value, err := pp.queryReplicas(ctx, client, func(ctx context.Context, a prometheus.API) (interface{}, error) {
+		value, _, err := a.Query(ctx, query, ts)
+		return value, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	v, _ := value.(prommodel.Value)
+	return v, nil
+}
+
+func (pp *prompool) QueryRange(ctx context.Context, server string, query string, r prometheus.Range) (prommodel.Value, error) {
+	pp.mtx.Lock()
+	client, _ := pp.clients[server]
+	pp.mtx.Unlock()
+
+	if client == nil {
+		return nil, fmt.Errorf("Could not send a query to unknown prometheus server (server=%s)", server)
+	}
+	value, err := pp.queryReplicas(ctx, client, func(ctx context.Context, a prometheus.API) (interface{}, error) {
+		value, _, err := a.QueryRange(ctx, query, r)
+		return value, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	v, _ := value.(prommodel.Value)
+	return v, nil
+}
+
+// Alerts returns the alerts of the server which are pending or firing.
+func (pp *prompool) Alerts(ctx context.Context, server string) ([]prometheus.Alert, error) {
 	pp.mtx.Lock()
-	client, _ := pp.clients[addr]
+	client, _ := pp.clients[server]
 	pp.mtx.Unlock()
 
 	if client == nil {
-		return nil, fmt.Errorf("Could not send a query to unknown prometheus addr (addr=%s)", addr)
+		return nil, fmt.Errorf("Could not get alerts from unknown prometheus server (server=%s)", server)
+	}
+	alerts, err := pp.queryReplicas(ctx, client, func(ctx context.Context, a prometheus.API) (interface{}, error) {
+		result, err := a.Alerts(ctx)
+		return result.Alerts, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	a, _ := alerts.([]prometheus.Alert)
+	return a, nil
+}
+
+// replicaQuery sends a request to a replica and returns a prommodel.Value,
+// or the []prometheus.Alert of an alerts request.
+type replicaQuery func(context.Context, prometheus.API) (interface{}, error)
+
+// queryReplicas sends the query to the replicas of the server according to
+// its strategy and records the health of every replica it was sent to.
+// Every request to a replica is subject to the limits of the server.
+func (pp *prompool) queryReplicas(ctx context.Context, client *promClient, query replicaQuery) (interface{}, error) {
+	if client.strategy == config.ReplicaMostSeries && len(client.replicas) > 1 {
+		return pp.queryMostSeries(ctx, client, query)
+	}
+
+	var lastErr error
+	replicas := client.healthOrdered()
+	for i, r := range replicas {
+		if i > 0 {
+			pp.metrics.replicaFailovers.WithLabelValues(client.name).Inc()
+		}
+		release, err := pp.acquire(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		// Each replica gets its share of the remaining time, so that a
+		// hanging replica leaves time for the next ones.
+		rctx, cancel := replicaContext(ctx, len(replicas)-i)
+		value, err := query(rctx, r.queryAPI)
+		cancel()
+		release()
+		if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+			// The query was cancelled, which says nothing about the replica.
+			return nil, ctx.Err()
+		}
+		pp.recordHealth(client, r, err)
+		if err == nil {
+			return value, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// replicaContext returns the context of a query to one of n replicas left to
+// try, whose deadline is an nth of the time remaining until the deadline of ctx.
+func replicaContext(ctx context.Context, n int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || n <= 1 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Until(deadline)/time.Duration(n))
+}
+
+// queryMostSeries sends the query to all replicas at once and returns the
+// result with the most series or alerts. It fails only if every replica failed.
+func (pp *prompool) queryMostSeries(ctx context.Context, client *promClient, query replicaQuery) (interface{}, error) {
+	values := make([]interface{}, len(client.replicas))
+	errs := make([]error, len(client.replicas))
+	sent := make([]bool, len(client.replicas))
+	var wg sync.WaitGroup
+	for i, r := range client.replicas {
+		wg.Add(1)
+		go func(i int, r *replica) {
+			defer wg.Done()
+			release, err := pp.acquire(ctx, client)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer release()
+			sent[i] = true
+			values[i], errs[i] = query(ctx, r.queryAPI)
+		}(i, r)
+	}
+	wg.Wait()
+	if errors.Is(ctx.Err(), context.Canceled) {
+		// The query was cancelled, which says nothing about the replicas.
+		return nil, ctx.Err()
+	}
+
+	// Replicas still running at the deadline are marked unhealthy, unlike
+	// those the query was never sent to within the limits of the server.
+	for i, r := range client.replicas {
+		if sent[i] {
+			pp.recordHealth(client, r, errs[i])
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	var (
+		best    interface{}
+		bestErr error
+		found   bool
+	)
+	for i := range client.replicas {
+		if errs[i] != nil {
+			if bestErr == nil {
+				bestErr = errs[i]
+			}
+			continue
+		}
+		if !found || seriesCount(values[i]) > seriesCount(best) {
+			best, found = values[i], true
+		}
+	}
+	if !found {
+		return nil, bestErr
+	}
+	return best, nil
+}
+
+func seriesCount(v interface{}) int {
+	switch v := v.(type) {
+	case prommodel.Vector:
+		return len(v)
+	case prommodel.Matrix:
+		return len(v)
+	case []prometheus.Alert:
+		return len(v)
+	}
+	return 0
+}
+
+// healthOrdered returns the replicas in their configured order with the
+// healthy ones first.
+func (c *promClient) healthOrdered() []*replica {
+	replicas := make([]*replica, 0, len(c.replicas))
+	var unhealthy []*replica
+	for _, r := range c.replicas {
+		r.mtx.Lock()
+		healthy := r.healthy
+		r.mtx.Unlock()
+		if healthy {
+			replicas = append(replicas, r)
+		} else {
+			unhealthy = append(unhealthy, r)
+		}
+	}
+	return append(replicas, unhealthy...)
+}
+
+func (pp *prompool) recordHealth(client *promClient, r *replica, err error) {
+	r.mtx.Lock()
+	wasHealthy := r.healthy
+	r.healthy = err == nil
+	r.lastCheck = time.Now()
+	r.lastError = ""
+	if err != nil {
+		r.lastError = err.Error()
+	}
+	r.mtx.Unlock()
+
+	up := 0.0
+	if err == nil {
+		up = 1
+	}
+	pp.metrics.replicaUp.WithLabelValues(client.name, r.addr).Set(up)
+	if len(client.replicas) < 2 || wasHealthy == (err == nil) {
+		return
+	}
+	if err != nil {
+		pp.logger.Warn("Prometheus replica became unhealthy",
+			zap.String("prometheus", client.name),
+			zap.String("replica", r.addr),
+			zap.Error(err))
+	} else {
+		pp.logger.Info("Prometheus replica became healthy",
+			zap.String("prometheus", client.name),
+			zap.String("replica", r.addr))
+	}
+}
+
+// replicaStatus returns the health of every replica sorted by server.
+func (pp *prompool) replicaStatus() []*model.ReplicaStatus {
+	pp.mtx.Lock()
+	clients := make([]*promClient, 0, len(pp.clients))
+	for _, c := range pp.clients {
+		clients = append(clients, c)
+	}
+	pp.mtx.Unlock()
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].name < clients[j].name
+	})
+
+	status := make([]*model.ReplicaStatus, 0, len(clients))
+	for _, c := range clients {
+		for _, r := range c.replicas {
+			r.mtx.Lock()
+			status = append(status, &model.ReplicaStatus{
+				Prometheus: c.name,
+				URL:        r.addr,
+				Healthy:    r.healthy,
+				LastCheck:  r.lastCheck,
+				LastError:  r.lastError,
+			})
+			r.mtx.Unlock()
+		}
 	}
-	value, _, err := client.queryAPI.Query(ctx, query, ts)
-	return value, err
+	return status
+}
+
+// acquire waits until a request can be sent to a replica of the server
+// without exceeding its limits. The returned function must be called when
+// the request is done.
+func (pp *prompool) acquire(ctx context.Context, client *promClient) (func(), error) {
+	if client.inFlight == nil && client.limiter == nil {
+		return func() {}, nil
+	}
+
+	queued := pp.metrics.queuedQueries.WithLabelValues(client.name)
+	queued.Inc()
+	start := time.Now()
+	defer func() {
+		queued.Dec()
+		pp.metrics.queueLatency.WithLabelValues(client.name).Observe(time.Since(start).Seconds())
+	}()
+
+	if client.inFlight != nil {
+		select {
+		case client.inFlight <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	release := func() {
+		if client.inFlight != nil {
+			<-client.inFlight
+		}
+	}
+
+	if client.limiter != nil {
+		if err := client.limiter.Wait(ctx); err != nil {
+			release()
+			return nil, err
+		}
+	}
+	return release, nil
 }
 
 func (pp *prompool) Stop() error {
 	return nil
 }
+
+// headersRoundTripper sets extra headers such as X-Scope-OrgID to every request.
+type headersRoundTripper struct {
+	headers map[string]promconfig.Secret
+	rt      http.RoundTripper
+}
+
+func (h *headersRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, v := range h.headers {
+		req.Header.Set(k, string(v))
+	}
+	return h.rt.RoundTrip(req)
+}
+
+// rangeQuerier answers the instant queries at the steps of a range from the
+// result of a single range query per query, so generating the snapshots of
+// the whole range costs one request per query instead of one per snapshot.
+// Queries at other times, queries whose range query failed and steps missing
+// from the result are sent to the underlying querier as instant queries.
+//
+// A range query is sent in the background on the first query for it and is
+// bounded by ctx rather than by the snapshot waiting for it, so the deadline
+// of ctx should cover the whole range. Queries wait for it until that
+// deadline even when their own one passes. The timeout of its attempts is the
+// QueryPolicy timeout scaled by the number of steps, and it is retried as
+// many times as the policy says.
+type rangeQuerier struct {
+	querier
+	ctx    context.Context
+	logger *zap.Logger
+	r      prometheus.Range
+
+	mtx     sync.Mutex
+	results map[string]*rangeResult
+}
+
+type rangeResult struct {
+	done    chan struct{}
+	vectors map[int64]prommodel.Vector
+	err     error
+}
+
+func newRangeQuerier(ctx context.Context, logger *zap.Logger, q querier, r prometheus.Range) *rangeQuerier {
+	return &rangeQuerier{
+		querier: q,
+		ctx:     ctx,
+		logger:  logger,
+		r:       r,
+		results: make(map[string]*rangeResult),
+	}
+}
+
+// stepRange returns the range of n steps starting at start. The start is
+// truncated to milliseconds, the precision of prometheus timestamps, so that
+// the steps match the timestamps of the result.
+func stepRange(start time.Time, step time.Duration, n int) prometheus.Range {
+	start = start.Truncate(time.Millisecond)
+	return prometheus.Range{
+		Start: start,
+		End:   start.Add(time.Duration(n-1) * step),
+		Step:  step,
+	}
+}
+
+// rangeSteps returns the evaluation times of r.
+func rangeSteps(r prometheus.Range) []time.Time {
+	steps := make([]time.Time, 0)
+	for ts := r.Start; !ts.After(r.End); ts = ts.Add(r.Step) {
+		steps = append(steps, ts)
+	}
+	return steps
+}
+
+func (rq *rangeQuerier) Query(ctx context.Context, server string, query string, ts time.Time) (prommodel.Value, error) {
+	at := ts.Truncate(time.Millisecond)
+	if at.Before(rq.r.Start) || at.After(rq.r.End) || at.Sub(rq.r.Start)%rq.r.Step != 0 {
+		return rq.querier.Query(ctx, server, query, ts)
+	}
+
+	rq.mtx.Lock()
+	res, ok := rq.results[resultKey(server, query)]
+	if !ok {
+		res = &rangeResult{done: make(chan struct{})}
+		rq.results[resultKey(server, query)] = res
+		go rq.queryRange(server, query, queryPolicyFrom(ctx), res)
+	}
+	rq.mtx.Unlock()
+
+	// The range query takes longer than a single query, so it is waited
+	// for until the deadline of the batch rather than that of the attempt.
+	select {
+	case <-res.done:
+	case <-rq.ctx.Done():
+		return nil, rq.ctx.Err()
+	}
+
+	vector, ok := res.vectors[at.UnixNano()]
+	if res.err == nil && ok {
+		return vector, nil
+	}
+	ctx, cancel := rq.instantContext(ctx)
+	defer cancel()
+	return rq.querier.Query(ctx, server, query, ts)
+}
+
+// instantContext returns the context of an instant query sent instead of
+// the range query. The deadline of the attempt may have passed while the
+// range query was waited for, in which case a new one is started.
+func (rq *rangeQuerier) instantContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx.Err() == nil {
+		return ctx, func() {}
+	}
+	policy := queryPolicyFrom(ctx)
+	ctx = withQueryPolicy(rq.ctx, policy)
+	if policy.Timeout > 0 {
+		return context.WithTimeout(ctx, time.Duration(policy.Timeout))
+	}
+	return context.WithCancel(ctx)
+}
+
+func (rq *rangeQuerier) queryRange(server, query string, policy config.QueryPolicy, res *rangeResult) {
+	defer close(res.done)
+	logger := rq.logger.With(
+		zap.String("prometheus", server),
+		zap.String("query", query))
+
+	steps := time.Duration(len(rangeSteps(rq.r)))
+	op := func() error {
+		ctx := rq.ctx
+		if policy.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, steps*time.Duration(policy.Timeout))
+			defer cancel()
+		}
+		value, err := rq.querier.QueryRange(ctx, server, query, rq.r)
+		if err != nil {
+			return err
+		}
+		matrix, ok := value.(prommodel.Matrix)
+		if !ok {
+			return backoff.Permanent(fmt.Errorf("Unexpected type of range query result: %s", value.Type()))
+		}
+		res.vectors = splitMatrix(matrix)
+		return nil
+	}
+	err := backoff.RetryNotify(op, backoff.WithContext(retryBackOff(policy), rq.ctx), func(err error, next time.Duration) {
+		logger.Warn("Failed to send range query, retrying", zap.Error(err), zap.Duration("next", next))
+	})
+	if err != nil {
+		logger.Warn("Failed to send range query, falling back to instant queries", zap.Error(err))
+		res.err = err
+	}
+}
+
+type queryPolicyKey struct{}
+
+// withQueryPolicy returns a context carrying the policy of the query sent
+// with it, so that queriers sending it differently can apply the policy.
+func withQueryPolicy(ctx context.Context, policy config.QueryPolicy) context.Context {
+	return context.WithValue(ctx, queryPolicyKey{}, policy)
+}
+
+func queryPolicyFrom(ctx context.Context) config.QueryPolicy {
+	policy, _ := ctx.Value(queryPolicyKey{}).(config.QueryPolicy)
+	return policy
+}
+
+// splitMatrix turns a matrix into the vectors at each of its timestamps,
+// keyed by unix nanoseconds.
+func splitMatrix(matrix prommodel.Matrix) map[int64]prommodel.Vector {
+	vectors := make(map[int64]prommodel.Vector)
+	for _, ss := range matrix {
+		for _, p := range ss.Values {
+			key := p.Timestamp.UnixNano()
+			vectors[key] = append(vectors[key], &prommodel.Sample{
+				Metric:    ss.Metric,
+				Value:     p.Value,
+				Timestamp: p.Timestamp,
+			})
+		}
+	}
+	return vectors
+}
+
+// coalescingQuerier sends identical instant queries only once while a
+// snapshot is generated. Concurrent callers share the in-flight query and
+// later callers reuse its result. Failed queries are not cached, so they can
+// be retried. The shared query is bounded by the context of the snapshot
+// rather than by that of a caller, which only stops waiting for it.
+type coalescingQuerier struct {
+	querier
+	ctx     context.Context
+	metrics *retrieverMetrics
+	group   singleflight.Group
+
+	mtx     sync.Mutex
+	results map[string]prommodel.Value
+}
+
+func newCoalescingQuerier(ctx context.Context, q querier, metrics *retrieverMetrics) *coalescingQuerier {
+	return &coalescingQuerier{
+		querier: q,
+		ctx:     ctx,
+		metrics: metrics,
+		results: make(map[string]prommodel.Value),
+	}
+}
+
+func (cq *coalescingQuerier) Query(ctx context.Context, server string, query string, ts time.Time) (prommodel.Value, error) {
+	key := fmt.Sprintf("%s\x00%d", resultKey(server, query), ts.UnixNano())
+
+	cq.mtx.Lock()
+	value, ok := cq.results[key]
+	cq.mtx.Unlock()
+	if ok {
+		cq.metrics.coalescedQueries.WithLabelValues(server).Inc()
+		return value, nil
+	}
+
+	// Only the caller starting the call sends the query.
+	sent := false
+	qctx := detachedContext{Context: cq.ctx, values: ctx}
+	ch := cq.group.DoChan(key, func() (interface{}, error) {
+		sent = true
+		value, err := cq.querier.Query(qctx, server, query, ts)
+		if err != nil {
+			return nil, err
+		}
+		cq.mtx.Lock()
+		cq.results[key] = value
+		cq.mtx.Unlock()
+		return value, nil
+	})
+
+	var res singleflight.Result
+	select {
+	case res = <-ch:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if !sent {
+		cq.metrics.coalescedQueries.WithLabelValues(server).Inc()
+	}
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	return res.Val.(prommodel.Value), nil
+}
+
+// detachedContext has the deadline and the cancellation of its Context but
+// the values of another one, such as the query policy of a caller.
+type detachedContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.values.Value(key)
+}
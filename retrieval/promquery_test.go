@@ -1 +1,455 @@
 package retrieval
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nghialv/promviz/config"
+	"github.com/nghialv/promviz/model"
+	"go.uber.org/zap"
+
+	prometheus "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoalescingQuerier(t *testing.T) {
+	q := &fakeQuerier{
+		values: map[string]prommodel.Value{
+			"shared": newTestVector("a", "b"),
+			"flaky":  newTestVector("b", "c"),
+		},
+		failures: map[string]int{
+			"flaky": 1,
+		},
+	}
+	metrics := newRetrieverMetrics(nil)
+	cq := newCoalescingQuerier(context.Background(), q, metrics)
+	ts := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := cq.Query(context.Background(), "prom", "shared", ts)
+			assert.NoError(t, err)
+			assert.Equal(t, q.values["shared"], v)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, q.calls["shared"])
+	assert.Equal(t, float64(4), testutil.ToFloat64(metrics.coalescedQueries.WithLabelValues("prom")))
+
+	// A failed query is sent again.
+	_, err := cq.Query(context.Background(), "prom", "flaky", ts)
+	require.Error(t, err)
+	_, err = cq.Query(context.Background(), "prom", "flaky", ts)
+	require.NoError(t, err)
+	assert.Equal(t, 2, q.calls["flaky"])
+
+	// The same query at another time is not coalesced.
+	_, err = cq.Query(context.Background(), "prom", "shared", ts.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 2, q.calls["shared"])
+}
+
+func TestCoalescingQuerierCallerTimeouts(t *testing.T) {
+	q := &delayedQuerier{
+		fakeQuerier: fakeQuerier{
+			values: map[string]prommodel.Value{"shared": newTestVector("a", "b")},
+		},
+		delay: 50 * time.Millisecond,
+	}
+	cq := newCoalescingQuerier(context.Background(), q, newRetrieverMetrics(nil))
+	ts := time.Now()
+
+	// The caller sending the query gives up on its own timeout, while the
+	// caller sharing it gets the result within its longer one.
+	var wg sync.WaitGroup
+	for _, timeout := range []time.Duration{10 * time.Millisecond, time.Second} {
+		timeout := timeout
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			v, err := cq.Query(ctx, "prom", "shared", ts)
+			if timeout < q.delay {
+				assert.Equal(t, context.DeadlineExceeded, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, q.values["shared"], v)
+		}()
+		time.Sleep(time.Millisecond)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, q.calls["shared"])
+
+	// The shared query is bounded by the context of the snapshot.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	cq = newCoalescingQuerier(ctx, q, newRetrieverMetrics(nil))
+	_, err := cq.Query(context.Background(), "prom", "shared", ts)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+// delayedQuerier answers instant queries after delay.
+type delayedQuerier struct {
+	fakeQuerier
+	delay time.Duration
+}
+
+func (d *delayedQuerier) Query(ctx context.Context, server, query string, ts time.Time) (prommodel.Value, error) {
+	select {
+	case <-time.After(d.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return d.fakeQuerier.Query(ctx, server, query, ts)
+}
+
+func TestPrompoolMaxConcurrentQueries(t *testing.T) {
+	var (
+		mtx               sync.Mutex
+		inFlight, maxSeen int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mtx.Lock()
+		inFlight++
+		if inFlight > maxSeen {
+			maxSeen = inFlight
+		}
+		mtx.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mtx.Lock()
+		inFlight--
+		mtx.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer srv.Close()
+
+	server := config.DefaultPrometheusServer
+	server.Name = "limited"
+	server.URL = srv.URL
+	server.MaxConcurrentQueries = 2
+	server.QueryRateLimit = 1000
+	cfg := &config.Config{
+		PrometheusServers: []*config.PrometheusServer{&server},
+	}
+
+	metrics := newRetrieverMetrics(nil)
+	pp, err := newQuerier(zap.NewNop(), cfg, metrics)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := pp.Query(context.Background(), "limited", "up", time.Now())
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 2, maxSeen)
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.queuedQueries.WithLabelValues("limited")))
+
+	// A query waiting for a slot gives up with its context.
+	pp.clients["limited"].inFlight <- struct{}{}
+	pp.clients["limited"].inFlight <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = pp.Query(ctx, "limited", "up", time.Now())
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// The limits bound the requests sent to every replica of a query.
+	replicated := config.DefaultPrometheusServer
+	replicated.Name = "replicated"
+	replicated.Replicas = []string{srv.URL, srv.URL + "/"}
+	replicated.ReplicaStrategy = config.ReplicaMostSeries
+	replicated.MaxConcurrentQueries = 2
+	cfg = &config.Config{
+		PrometheusServers: []*config.PrometheusServer{&replicated},
+	}
+	pp, err = newQuerier(zap.NewNop(), cfg, newRetrieverMetrics(nil))
+	require.NoError(t, err)
+	maxSeen = 0
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := pp.Query(context.Background(), "replicated", "up", time.Now())
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 2, maxSeen)
+
+	// Replicas the query was not sent to within the limits stay healthy.
+	pp.clients["replicated"].inFlight <- struct{}{}
+	pp.clients["replicated"].inFlight <- struct{}{}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = pp.Query(ctx, "replicated", "up", time.Now())
+	assert.Equal(t, context.DeadlineExceeded, err)
+	for _, r := range pp.replicaStatus() {
+		assert.True(t, r.Healthy, r.URL)
+	}
+}
+
+func TestPrompoolReplicas(t *testing.T) {
+	newReplica := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if body == "" {
+				http.Error(w, "restarting", http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(body))
+		}))
+	}
+	down := newReplica("")
+	defer down.Close()
+	one := newReplica(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"a"},"value":[0,"1"]}]}}`)
+	defer one.Close()
+	two := newReplica(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"a"},"value":[0,"1"]},{"metric":{"job":"b"},"value":[0,"1"]}]}}`)
+	defer two.Close()
+
+	newPool := func(strategy config.ReplicaStrategy, urls ...string) (*prompool, *retrieverMetrics) {
+		server := config.DefaultPrometheusServer
+		server.Name = "ha"
+		server.Replicas = urls
+		server.ReplicaStrategy = strategy
+		metrics := newRetrieverMetrics(nil)
+		pp, err := newQuerier(zap.NewNop(), &config.Config{
+			PrometheusServers: []*config.PrometheusServer{&server},
+		}, metrics)
+		require.NoError(t, err)
+		return pp, metrics
+	}
+
+	pp, metrics := newPool(config.ReplicaFailover, down.URL, one.URL)
+	value, err := pp.Query(context.Background(), "ha", "up", time.Now())
+	require.NoError(t, err)
+	assert.Len(t, value, 1)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.replicaFailovers.WithLabelValues("ha")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.replicaUp.WithLabelValues("ha", down.URL)))
+
+	status := pp.replicaStatus()
+	require.Len(t, status, 2)
+	assert.False(t, status[0].Healthy)
+	assert.NotEmpty(t, status[0].LastError)
+	assert.True(t, status[1].Healthy)
+
+	// The unhealthy replica is tried last, so no failover is needed anymore.
+	_, err = pp.Query(context.Background(), "ha", "up", time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.replicaFailovers.WithLabelValues("ha")))
+
+	pp, _ = newPool(config.ReplicaMostSeries, one.URL, two.URL, down.URL)
+	value, err = pp.Query(context.Background(), "ha", "up", time.Now())
+	require.NoError(t, err)
+	assert.Len(t, value, 2)
+
+	pp, _ = newPool(config.ReplicaMostSeries, down.URL, down.URL)
+	_, err = pp.Query(context.Background(), "ha", "up", time.Now())
+	assert.Error(t, err)
+
+	// A replica hanging until the deadline only gets its share of the time
+	// and is marked unhealthy.
+	released := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-released:
+		}
+	}))
+	defer hanging.Close()
+	defer close(released)
+
+	pp, _ = newPool(config.ReplicaFailover, hanging.URL, one.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	value, err = pp.Query(ctx, "ha", "up", time.Now())
+	require.NoError(t, err)
+	assert.Len(t, value, 1)
+	status = pp.replicaStatus()
+	assert.False(t, status[0].Healthy)
+	assert.Contains(t, status[0].LastError, "deadline exceeded")
+	assert.True(t, status[1].Healthy)
+
+	pp, _ = newPool(config.ReplicaMostSeries, hanging.URL, one.URL)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = pp.Query(ctx, "ha", "up", time.Now())
+	assert.Equal(t, context.DeadlineExceeded, err)
+	status = pp.replicaStatus()
+	assert.False(t, status[0].Healthy)
+	assert.True(t, status[1].Healthy)
+
+	// A cancelled query says nothing about the replicas.
+	pp, _ = newPool(config.ReplicaFailover, hanging.URL, one.URL)
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = pp.Query(ctx, "ha", "up", time.Now())
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, pp.replicaStatus()[0].Healthy)
+}
+
+// rangeFakeQuerier answers range queries with matrix after failing the first
+// rangeFailures of them.
+type rangeFakeQuerier struct {
+	fakeQuerier
+	matrix        prommodel.Matrix
+	rangeFailures int
+	rangeCalls    int
+	ranges        []prometheus.Range
+}
+
+func (f *rangeFakeQuerier) QueryRange(ctx context.Context, server, query string, r prometheus.Range) (prommodel.Value, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.rangeCalls++
+	f.ranges = append(f.ranges, r)
+	if f.rangeCalls <= f.rangeFailures {
+		return nil, errors.New("unavailable")
+	}
+	return f.matrix, nil
+}
+
+func TestRangeQuerier(t *testing.T) {
+	// The tick has a sub-millisecond remainder of more than half a millisecond.
+	start := time.Unix(1500000000, 700700000)
+	ms := prommodel.TimeFromUnixNano(start.UnixNano())
+	q := &rangeFakeQuerier{
+		fakeQuerier: fakeQuerier{
+			values: map[string]prommodel.Value{"up": prommodel.Vector{{Value: 42}}},
+		},
+		matrix: prommodel.Matrix{
+			{
+				Metric: prommodel.Metric{"source": "a"},
+				Values: []prommodel.SamplePair{{Timestamp: ms, Value: 1}, {Timestamp: ms.Add(2 * time.Minute), Value: 3}},
+			},
+		},
+		rangeFailures: 1,
+	}
+	rng := stepRange(start, time.Minute, 3)
+	assert.Equal(t, time.Unix(1500000000, 700000000), rng.Start)
+
+	rq := newRangeQuerier(context.Background(), zap.NewNop(), q, rng)
+	ctx := withQueryPolicy(context.Background(), config.QueryPolicy{Retries: 1, RetryBackoff: prommodel.Duration(time.Millisecond)})
+	steps := rangeSteps(rng)
+	require.Len(t, steps, 3)
+
+	v, err := rq.Query(ctx, "p", "up", steps[0])
+	require.NoError(t, err)
+	assert.Equal(t, prommodel.SampleValue(1), v.(prommodel.Vector)[0].Value)
+	// The range query is retried as the policy of the query says.
+	assert.Equal(t, 2, q.rangeCalls)
+
+	// The step missing from the result falls back to an instant query.
+	v, err = rq.Query(ctx, "p", "up", steps[1])
+	require.NoError(t, err)
+	assert.Equal(t, prommodel.SampleValue(42), v.(prommodel.Vector)[0].Value)
+	assert.Equal(t, 1, q.calls["up"])
+
+	v, err = rq.Query(ctx, "p", "up", steps[2])
+	require.NoError(t, err)
+	assert.Equal(t, prommodel.SampleValue(3), v.(prommodel.Vector)[0].Value)
+	assert.Equal(t, 2, q.rangeCalls)
+	assert.Equal(t, 1, q.calls["up"])
+}
+
+func TestRangeQuerierDeadline(t *testing.T) {
+	released := make(chan struct{})
+	q := &blockingRangeQuerier{released: released}
+	rng := stepRange(time.Unix(1500000000, 0), time.Minute, 2)
+	rctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	rq := newRangeQuerier(rctx, zap.NewNop(), q, rng)
+
+	// The range query is waited for until the deadline of the batch.
+	_, err := rq.Query(context.Background(), "p", "up", rng.Start)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	close(released)
+}
+
+func TestRangeQuerierQueryTimeout(t *testing.T) {
+	q := &slowRangeQuerier{
+		fakeQuerier: fakeQuerier{
+			values: map[string]prommodel.Value{"up": prommodel.Vector{{Value: 42}}},
+		},
+		delay: 50 * time.Millisecond,
+	}
+	rng := stepRange(time.Unix(1500000000, 0), time.Minute, 3)
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	rq := newRangeQuerier(rctx, zap.NewNop(), q, rng)
+	g := &generator{
+		logger:  zap.NewNop(),
+		metrics: newRetrieverMetrics(nil),
+		querier: rq,
+	}
+
+	// Each attempt of the query times out before the range query returns,
+	// which is given the timeout scaled by the number of steps.
+	policy := config.QueryPolicy{Timeout: prommodel.Duration(30 * time.Millisecond)}
+	status := &model.QueryStatus{Prometheus: "p", Expr: "up"}
+	result, err := g.query(context.Background(), status, policy, rng.Start, func(ctx context.Context) (prommodel.Value, error) {
+		return rq.Query(ctx, "p", "up", rng.Start)
+	})
+	require.NoError(t, err)
+	require.NotNil(t, result)
+	assert.Equal(t, prommodel.SampleValue(1), result.value.(prommodel.Vector)[0].Value)
+	assert.Equal(t, 0, q.calls["up"])
+	assert.InDelta(t, 90*time.Millisecond, q.timeout, float64(20*time.Millisecond))
+}
+
+// slowRangeQuerier answers range queries after delay and records the
+// timeout they were given.
+type slowRangeQuerier struct {
+	fakeQuerier
+	delay   time.Duration
+	timeout time.Duration
+}
+
+func (s *slowRangeQuerier) QueryRange(ctx context.Context, server, query string, r prometheus.Range) (prommodel.Value, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		s.timeout = time.Until(deadline)
+	}
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return prommodel.Matrix{
+		{Values: []prommodel.SamplePair{{Timestamp: prommodel.TimeFromUnixNano(r.Start.UnixNano()), Value: 1}}},
+	}, nil
+}
+
+type blockingRangeQuerier struct {
+	fakeQuerier
+	released chan struct{}
+}
+
+func (b *blockingRangeQuerier) QueryRange(ctx context.Context, server, query string, r prometheus.Range) (prommodel.Value, error) {
+	select {
+	case <-b.released:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return prommodel.Matrix{
+		{Values: []prommodel.SamplePair{{Timestamp: prommodel.TimeFromUnixNano(r.End.UnixNano()), Value: 1}}},
+	}, nil
+}
@@ -2,12 +2,16 @@ package retrieval
 
 import (
 	"context"
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/nghialv/promviz/config"
+	"github.com/nghialv/promviz/model"
 	"github.com/nghialv/promviz/storage"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
@@ -20,21 +24,45 @@ var (
 	ErrConfigNotSet = errors.New("Config has been not set")
 )
 
+// maxQueueLength is the maximum number of ticks waiting to be retrieved.
+// The oldest ones are dropped when the retriever falls further behind.
+const maxQueueLength = 360
+
 type Retriever interface {
 	Run()
 	Stop()
 	ApplyConfig(*config.Config) error
+	ValidateConfig(*config.Config) error
+	Config() *config.Config
+	QueryStatus() []*model.QueryStatus
+	ReplicaStatus() []*model.ReplicaStatus
 }
 
 type Options struct {
 	ScrapeInterval time.Duration
 	ScrapeTimeout  time.Duration
-	Appender       storage.Appender
+	// StalenessWindow is how long the last successful result of a query
+	// with onError: reuseLast can be reused while the query keeps failing.
+	StalenessWindow time.Duration
+	Appender        storage.Appender
+	ConfigHistory   storage.ConfigHistory
 }
 
 type retrieverMetrics struct {
 	ops       *prometheus.CounterVec
 	opLatency *prometheus.SummaryVec
+
+	queryLatency   *prometheus.SummaryVec
+	queryFailures  *prometheus.CounterVec
+	querySeries    *prometheus.GaugeVec
+	droppedSamples *prometheus.CounterVec
+
+	coalescedQueries *prometheus.CounterVec
+	queuedQueries    *prometheus.GaugeVec
+	queueLatency     *prometheus.SummaryVec
+
+	replicaUp        *prometheus.GaugeVec
+	replicaFailovers *prometheus.CounterVec
 }
 
 func newRetrieverMetrics(r prometheus.Registerer) *retrieverMetrics {
@@ -55,12 +83,93 @@ func newRetrieverMetrics(r prometheus.Registerer) *retrieverMetrics {
 		},
 			[]string{"op", "status"},
 		),
+		queryLatency: prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "query_latency_seconds",
+			Help:      "Latency for sending a query including its retries.",
+		},
+			[]string{"cluster", "query", "prometheus"},
+		),
+		queryFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "query_failures_total",
+			Help:      "Total number of queries failed after their retries.",
+		},
+			[]string{"cluster", "query", "prometheus"},
+		),
+		querySeries: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "query_series",
+			Help:      "Number of series returned by the latest run of a query.",
+		},
+			[]string{"cluster", "query", "prometheus"},
+		),
+		droppedSamples: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "dropped_samples_total",
+			Help:      "Total number of samples dropped because no node name could be extracted.",
+		},
+			[]string{"cluster", "query", "prometheus"},
+		),
+		coalescedQueries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "coalesced_queries_total",
+			Help:      "Total number of queries not sent because an identical query was sent for the same snapshot.",
+		},
+			[]string{"prometheus"},
+		),
+		queuedQueries: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "queued_queries",
+			Help:      "Number of queries waiting for the concurrency or rate limit of a prometheus server.",
+		},
+			[]string{"prometheus"},
+		),
+		queueLatency: prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "query_queue_latency_seconds",
+			Help:      "Time a query waited for the concurrency or rate limit of a prometheus server.",
+		},
+			[]string{"prometheus"},
+		),
+		replicaUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "replica_up",
+			Help:      "Whether the latest query sent to a replica of a prometheus server succeeded.",
+		},
+			[]string{"prometheus", "replica"},
+		),
+		replicaFailovers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "replica_failovers_total",
+			Help:      "Total number of queries sent to another replica because the previous one failed.",
+		},
+			[]string{"prometheus"},
+		),
 	}
 
 	if r != nil {
 		r.MustRegister(
 			m.ops,
 			m.opLatency,
+			m.queryLatency,
+			m.queryFailures,
+			m.querySeries,
+			m.droppedSamples,
+			m.coalescedQueries,
+			m.queuedQueries,
+			m.queueLatency,
+			m.replicaUp,
+			m.replicaFailovers,
 		)
 	}
 	return m
@@ -72,9 +181,20 @@ type retriever struct {
 	config  *config.Config
 	metrics *retrieverMetrics
 
-	appender storage.Appender
-	querier  querier
-	queue    chan time.Time
+	appender   storage.Appender
+	querier    querier
+	sources    map[string]DataSource
+	discoverer *clusterDiscoverer
+
+	// queue holds the ticks waiting to be retrieved and queueCh is notified
+	// when a tick is added, so the ticker never blocks on a slow retrieval.
+	queue    []time.Time
+	queueMtx sync.Mutex
+	queueCh  chan struct{}
+
+	// lastResults are the query results of the latest snapshot.
+	lastResults map[string]*queryResult
+	queryStatus []*model.QueryStatus
 
 	mtx    sync.RWMutex
 	ctx    context.Context
@@ -91,7 +211,7 @@ func NewRetriever(logger *zap.Logger, r prometheus.Registerer, opts *Options) Re
 		metrics: newRetrieverMetrics(r),
 
 		appender: opts.Appender,
-		queue:    make(chan time.Time, 10),
+		queueCh:  make(chan struct{}, 1),
 
 		ctx:    ctx,
 		cancel: cancel,
@@ -103,13 +223,7 @@ func (r *retriever) Run() {
 	r.logger.Info("Starting retriever...")
 	defer close(r.doneCh)
 
-	retrieve := func(ts time.Time) {
-		r.logger.Info("Retrieve prometheus data and generate graph data")
-		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(r.options.ScrapeTimeout))
-		r.retrieve(ctx, ts)
-		cancel()
-	}
-	retrieve(time.Now())
+	r.retrieveAll([]time.Time{time.Now()})
 
 	go func() {
 		for {
@@ -117,8 +231,8 @@ func (r *retriever) Run() {
 			case <-r.ctx.Done():
 				return
 
-			case ts := <-r.queue:
-				retrieve(ts)
+			case <-r.queueCh:
+				r.retrieveAll(r.dequeue())
 			}
 		}
 	}()
@@ -131,11 +245,77 @@ func (r *retriever) Run() {
 		case <-r.ctx.Done():
 			return
 		case ts := <-ticker.C:
-			r.queue <- ts
+			r.enqueue(ts)
 		}
 	}
 }
 
+func (r *retriever) enqueue(ts time.Time) {
+	r.queueMtx.Lock()
+	r.queue = append(r.queue, ts)
+	if n := len(r.queue) - maxQueueLength; n > 0 {
+		r.logger.Warn("Dropped ticks the retriever fell too far behind", zap.Int("dropped", n))
+		r.queue = r.queue[n:]
+	}
+	r.queueMtx.Unlock()
+
+	select {
+	case r.queueCh <- struct{}{}:
+	default:
+	}
+}
+
+func (r *retriever) dequeue() []time.Time {
+	r.queueMtx.Lock()
+	defer r.queueMtx.Unlock()
+	tss := r.queue
+	r.queue = nil
+	return tss
+}
+
+// retrieveAll generates the snapshots of the given ticks. When the retriever
+// has fallen behind, every query is sent once as a range query covering all
+// of them. The snapshots are then stamped with the steps of the range, which
+// start at the first tick and are one scrape interval apart, instead of the
+// times of the queued ticks, since the ticks drift from the steps a little.
+// The range queries may take as long as the whole batch, so the first
+// snapshot, which waits for them, gets the deadline of the batch.
+func (r *retriever) retrieveAll(tss []time.Time) {
+	var (
+		rq            *rangeQuerier
+		batchDeadline time.Time
+	)
+	if len(tss) > 1 {
+		rng := stepRange(tss[0], r.options.ScrapeInterval, len(tss))
+		batchDeadline = time.Now().Add(time.Duration(len(tss)) * r.options.ScrapeTimeout)
+		rctx, cancel := context.WithDeadline(r.ctx, batchDeadline)
+		defer cancel()
+		r.mtx.RLock()
+		if r.querier != nil {
+			rq = newRangeQuerier(rctx, r.logger, r.querier, rng)
+		}
+		r.mtx.RUnlock()
+		tss = rangeSteps(rng)
+		r.logger.Info("Catching up with range queries", zap.Int("snapshots", len(tss)))
+	}
+
+	for i, ts := range tss {
+		select {
+		case <-r.ctx.Done():
+			return
+		default:
+		}
+		r.logger.Info("Retrieve prometheus data and generate graph data")
+		deadline := time.Now().Add(r.options.ScrapeTimeout)
+		if i == 0 && rq != nil {
+			deadline = batchDeadline
+		}
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		r.retrieve(ctx, ts, rq)
+		cancel()
+	}
+}
+
 func (r *retriever) Stop() {
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
@@ -153,27 +333,116 @@ func (r *retriever) Stop() {
 }
 
 func (r *retriever) ApplyConfig(cfg *config.Config) error {
-	q, err := newQuerier(r.logger, cfg)
+	if err := cfg.ValidateQueries(); err != nil {
+		return err
+	}
+	q, err := newQuerier(r.logger, cfg, r.metrics)
+	if err != nil {
+		return err
+	}
+	sources, err := newDataSources(r.logger, cfg)
 	if err != nil {
 		return err
 	}
 
 	r.mtx.Lock()
-	defer r.mtx.Unlock()
-
+	old := r.config
 	r.config = cfg
 	r.querier = q
+	r.sources = sources
+	r.discoverer = newClusterDiscoverer(r.logger, cfg)
+	r.queryStatus = nil
+	r.mtx.Unlock()
+	// Series of the queries and replicas removed by the new config should not be exported anymore.
+	r.metrics.queryLatency.Reset()
+	r.metrics.queryFailures.Reset()
+	r.metrics.querySeries.Reset()
+	r.metrics.droppedSamples.Reset()
+	r.metrics.replicaUp.Reset()
+
 	r.logger.Info("Applied new configuration")
+	r.recordConfig(old, cfg)
 
 	return nil
 }
 
-func (r *retriever) retrieve(ctx context.Context, ts time.Time) (err error) {
+// recordConfig logs the changes from the previously applied config and
+// keeps the new one in the config history unless it is the latest record.
+// Only the redacted config and changes are logged and kept, so that the
+// history does not leak secrets.
+func (r *retriever) recordConfig(old, cfg *config.Config) {
+	data, err := cfg.MarshalRedacted()
+	if err != nil {
+		r.logger.Error("Failed to marshal config", zap.Error(err))
+		return
+	}
+	hash := fmt.Sprintf("%x", sha256.Sum256(data))
+
+	changes, err := config.Diff(old, cfg)
+	if err != nil {
+		r.logger.Error("Failed to compute config diff", zap.Error(err))
+		return
+	}
+	for _, c := range changes {
+		r.logger.Info("Config changed",
+			zap.String("kind", c.Kind),
+			zap.String("path", c.Path),
+			zap.Any("old", c.Old),
+			zap.Any("new", c.New))
+	}
+
+	if r.options.ConfigHistory == nil {
+		return
+	}
+	// The hash only covers the redacted config, so a config whose
+	// substituted values changed since the previous one is recorded too.
+	if records, err := r.options.ConfigHistory.GetConfigHistory(); err == nil && len(records) > 0 && records[0].Hash == hash && !old.ChangedSecrets(cfg) {
+		return
+	}
+	err = r.options.ConfigHistory.AddConfigRecord(&model.ConfigRecord{
+		Timestamp: time.Now(),
+		Hash:      hash,
+		Config:    string(data),
+		Changes:   changes,
+	})
+	if err != nil {
+		r.logger.Error("Failed to add config to history", zap.Error(err))
+	}
+}
+
+// ValidateConfig checks whether the given config could be applied without applying it.
+func (r *retriever) ValidateConfig(cfg *config.Config) error {
+	if err := cfg.ValidateQueries(); err != nil {
+		return err
+	}
+	q, err := newQuerier(r.logger, cfg, r.metrics)
+	if err != nil {
+		return err
+	}
+	if _, err := newDataSources(r.logger, cfg); err != nil {
+		return err
+	}
+	return q.Stop()
+}
+
+// Config returns the currently applied config.
+func (r *retriever) Config() *config.Config {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.config
+}
+
+// retrieve generates and stores the snapshot at ts. The range querier is used
+// instead of the current querier as long as it wraps the current one.
+func (r *retriever) retrieve(ctx context.Context, ts time.Time, rq *rangeQuerier) (err error) {
 	defer track(r.metrics, "Retrieve")(&err)
 
 	r.mtx.RLock()
 	cfg := r.config
 	querier := r.querier
+	sources := r.sources
+	discoverer := r.discoverer
+	lastResults := r.lastResults
 	r.mtx.RUnlock()
 
 	if cfg == nil {
@@ -181,13 +450,26 @@ func (r *retriever) retrieve(ctx context.Context, ts time.Time) (err error) {
 		return ErrConfigNotSet
 	}
 
+	if rq != nil && rq.querier == querier {
+		querier = rq
+	}
+	// Identical queries of different connections are sent once per snapshot.
+	querier = newCoalescingQuerier(ctx, querier, r.metrics)
+	cfg = discoverer.apply(ctx, querier, cfg, ts)
+
 	g := &generator{
-		logger:  r.logger,
-		cfg:     cfg,
-		querier: querier,
+		logger:          r.logger,
+		metrics:         r.metrics,
+		cfg:             cfg,
+		querier:         querier,
+		sources:         sources,
+		lastResults:     lastResults,
+		stalenessWindow: r.options.StalenessWindow,
 	}
 
 	snapshot, err := g.generateSnapshot(ctx, ts)
+	r.updateLastResults(g.results, err != nil)
+	r.updateQueryStatus(append(g.queryStatus, discoverer.queryStatus()...))
 	if err != nil {
 		r.logger.Error("Failed to generate graph data", zap.Error(err))
 		return
@@ -202,6 +484,60 @@ func (r *retriever) retrieve(ctx context.Context, ts time.Time) (err error) {
 	return
 }
 
+func (r *retriever) updateLastResults(results map[string]*queryResult, failed bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.lastResults = nextResults(r.lastResults, results, failed)
+}
+
+// nextResults returns the results kept for the next snapshot. The previous
+// results are kept for the queries missing from a failed snapshot.
+func nextResults(last, results map[string]*queryResult, failed bool) map[string]*queryResult {
+	if !failed {
+		return results
+	}
+	for k, v := range last {
+		if _, ok := results[k]; !ok {
+			if results == nil {
+				results = make(map[string]*queryResult)
+			}
+			results[k] = v
+		}
+	}
+	return results
+}
+
+func (r *retriever) updateQueryStatus(status []*model.QueryStatus) {
+	sort.Slice(status, func(i, j int) bool {
+		if status[i].Cluster != status[j].Cluster {
+			return status[i].Cluster < status[j].Cluster
+		}
+		return status[i].Query < status[j].Query
+	})
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.queryStatus = status
+}
+
+// QueryStatus returns the status of every configured query for the latest snapshot.
+func (r *retriever) QueryStatus() []*model.QueryStatus {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.queryStatus
+}
+
+// ReplicaStatus returns the health of every prometheus server replica of the applied config.
+func (r *retriever) ReplicaStatus() []*model.ReplicaStatus {
+	r.mtx.RLock()
+	q := r.querier
+	r.mtx.RUnlock()
+	if pp, ok := q.(*prompool); ok {
+		return pp.replicaStatus()
+	}
+	return nil
+}
+
 func track(metrics *retrieverMetrics, op string) func(*error) {
 	start := time.Now()
 	return func(err *error) {
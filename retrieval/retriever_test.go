@@ -1 +1,173 @@
 package retrieval
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nghialv/promviz/config"
+	"github.com/nghialv/promviz/model"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRetrieverQueue(t *testing.T) {
+	r := NewRetriever(zap.NewNop(), nil, &Options{}).(*retriever)
+
+	start := time.Unix(1500000000, 0)
+	for i := 0; i < maxQueueLength+10; i++ {
+		r.enqueue(start.Add(time.Duration(i) * time.Second))
+	}
+	assert.Len(t, r.queueCh, 1)
+
+	tss := r.dequeue()
+	assert.Len(t, tss, maxQueueLength)
+	assert.Equal(t, start.Add(10*time.Second), tss[0])
+	assert.Empty(t, r.dequeue())
+}
+
+type fakeConfigHistory struct {
+	records []*model.ConfigRecord
+}
+
+func (f *fakeConfigHistory) AddConfigRecord(record *model.ConfigRecord) error {
+	f.records = append([]*model.ConfigRecord{record}, f.records...)
+	return nil
+}
+
+func (f *fakeConfigHistory) GetConfigHistory() ([]*model.ConfigRecord, error) {
+	return f.records, nil
+}
+
+func TestRetrieverRecordConfig(t *testing.T) {
+	t.Setenv("PROMVIZ_TEST_TOKEN", "token-from-env")
+	load := func(header string) *config.Config {
+		cfg, err := config.Load([]byte(fmt.Sprintf(`graphName: Test
+prometheusServers:
+  - name: main
+    url: http://localhost:9090/${PROMVIZ_TEST_TOKEN}
+    headers:
+      X-Scope-OrgID: %s
+`, header)), &config.LoadOptions{})
+		require.NoError(t, err)
+		return cfg
+	}
+
+	core, logs := observer.New(zap.InfoLevel)
+	history := &fakeConfigHistory{}
+	r := NewRetriever(zap.New(core), nil, &Options{ConfigHistory: history}).(*retriever)
+
+	old := load("header-secret-1")
+	r.recordConfig(nil, old)
+	r.recordConfig(old, load("header-secret-2"))
+
+	// Only the headers change, so the redacted config is recorded once.
+	require.Len(t, history.records, 1)
+
+	// A changed variable is recorded although its value is redacted.
+	t.Setenv("PROMVIZ_TEST_TOKEN", "token-from-env-2")
+	r.recordConfig(old, load("header-secret-1"))
+	require.Len(t, history.records, 2)
+	record := history.records[0]
+	assert.Equal(t, history.records[1].Hash, record.Hash)
+	assert.Contains(t, record.Config, "X-Scope-OrgID: <secret>")
+	assert.NotContains(t, record.Config, "header-secret")
+	assert.NotContains(t, record.Config, "token-from-env")
+	for _, c := range record.Changes {
+		assert.NotContains(t, fmt.Sprint(c.New), "header-secret")
+		assert.NotContains(t, fmt.Sprint(c.New), "token-from-env")
+	}
+	assert.Contains(t, record.Config, "url: <secret>")
+
+	require.NotZero(t, logs.FilterMessage("Config changed").Len())
+	for _, entry := range logs.All() {
+		for k, v := range entry.ContextMap() {
+			assert.NotContains(t, fmt.Sprint(v), "header-secret", k)
+			assert.NotContains(t, fmt.Sprint(v), "token-from-env", k)
+		}
+	}
+}
+
+func TestRetrieverQueryStatus(t *testing.T) {
+	conn := newTestConnection("requests", config.QueryPolicy{})
+	tmplConn := newTestConnection(`requests{cluster="{{ .cluster }}"}`, config.QueryPolicy{})
+	tmplConn.Metrics = []*config.ConnectionMetric{{Name: "p99", Query: "latency"}}
+	cfg := &config.Config{
+		ClusterLevel: []*config.Cluster{
+			{Cluster: "cluster-1", Connections: []*config.Connection{conn}},
+		},
+		ClusterTemplates: []*config.ClusterTemplate{
+			{
+				Discovery: config.ClusterDiscovery{Query: "clusters", Label: "cluster", PrometheusURL: "http://prometheus"},
+				Template: &config.Cluster{
+					Connections: []*config.Connection{tmplConn},
+					ChildLevel: []*config.Cluster{
+						{Cluster: "child", Connections: []*config.Connection{newTestConnection("child", config.QueryPolicy{})}},
+					},
+				},
+			},
+		},
+	}
+	q := &fakeQuerier{
+		values: map[string]prommodel.Value{
+			"requests": newTestVector("a", "b"),
+			"clusters": prommodel.Vector{},
+		},
+	}
+	r := NewRetriever(zap.NewNop(), nil, &Options{Appender: &fakeAppender{}}).(*retriever)
+	r.config, r.querier, r.discoverer = cfg, q, newClusterDiscoverer(zap.NewNop(), cfg)
+
+	// The snapshot is in the past, like the snapshots of a catch-up.
+	before := time.Now()
+	require.NoError(t, r.retrieve(context.Background(), before.Add(-time.Hour), nil))
+
+	status := make(map[string]*model.QueryStatus)
+	for _, s := range r.QueryStatus() {
+		status[s.Cluster+" "+s.Query] = s
+	}
+	assert.Len(t, status, 5)
+
+	s := status["cluster-1 serviceConnections[0]"]
+	require.NotNil(t, s)
+	assert.False(t, s.Skipped)
+	assert.Equal(t, 1, s.Series)
+	assert.False(t, s.LastRun.Before(before))
+
+	s = status[" clusterTemplates[0].discovery"]
+	require.NotNil(t, s)
+	assert.Equal(t, "clusters", s.Expr)
+	assert.False(t, s.LastRun.Before(before))
+
+	// The template has not discovered any cluster, so its queries are skipped.
+	for _, key := range []string{
+		"clusterTemplates[0] serviceConnections[0]",
+		"clusterTemplates[0] serviceConnections[0].metrics[0]",
+		"clusterTemplates[0]/child serviceConnections[0]",
+	} {
+		require.Contains(t, status, key)
+		assert.True(t, status[key].Skipped, key)
+		assert.True(t, status[key].LastRun.IsZero(), key)
+	}
+	assert.Equal(t, `requests{cluster="{{ .cluster }}"}`, status["clusterTemplates[0] serviceConnections[0]"].Expr)
+}
+
+func TestRetrieverApplyConfigResetsMetrics(t *testing.T) {
+	r := NewRetriever(zap.NewNop(), nil, &Options{}).(*retriever)
+	r.metrics.queryLatency.WithLabelValues("old", "serviceConnections[0]", "p").Observe(1)
+	r.metrics.queryFailures.WithLabelValues("old", "serviceConnections[0]", "p").Inc()
+	r.metrics.querySeries.WithLabelValues("old", "serviceConnections[0]", "p").Set(1)
+	r.metrics.droppedSamples.WithLabelValues("old", "serviceConnections[0]", "p").Inc()
+	r.queryStatus = []*model.QueryStatus{{Cluster: "old"}}
+
+	require.NoError(t, r.ApplyConfig(&config.Config{}))
+	assert.Equal(t, 0, testutil.CollectAndCount(r.metrics.queryLatency))
+	assert.Equal(t, 0, testutil.CollectAndCount(r.metrics.queryFailures))
+	assert.Equal(t, 0, testutil.CollectAndCount(r.metrics.querySeries))
+	assert.Equal(t, 0, testutil.CollectAndCount(r.metrics.droppedSamples))
+	assert.Empty(t, r.QueryStatus())
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"errors"
+	"time"
+
+	"github.com/nghialv/promviz/model"
+	"go.uber.org/zap"
+)
+
+var ErrBackfillLiveChunk = errors.New("Unabled to backfill a snapshot into the chunk being written by the server")
+
+// Backfiller is an Appender writing snapshots generated for past timestamps
+// directly into completed chunk files. Snapshots must be added in ascending
+// order of their timestamps. Close must be called to write the last chunk.
+type Backfiller interface {
+	Appender
+	Close() error
+}
+
+type backfiller struct {
+	*storage
+	liveChunkID int64
+	chunk       Chunk
+}
+
+// NewBackfiller returns a Backfiller writing chunks into the storage at path.
+// Chunks starting from the current one are left to the running server.
+func NewBackfiller(path string, logger *zap.Logger) (Backfiller, error) {
+	s := &storage{
+		dbDir:   path,
+		logger:  logger,
+		metrics: newStorageMetrics(nil),
+	}
+	if err := mkdirIfNotExist(s.dbDir); err != nil {
+		return nil, err
+	}
+	return &backfiller{
+		storage:     s,
+		liveChunkID: ChunkID(time.Now()),
+	}, nil
+}
+
+func (b *backfiller) Add(snapshot *model.Snapshot) (err error) {
+	defer track(b.metrics, "Backfill")(&err)
+
+	chunkID := ChunkID(snapshot.Timestamp)
+	if chunkID >= b.liveChunkID {
+		return ErrBackfillLiveChunk
+	}
+
+	if b.chunk != nil && b.chunk.ID() != chunkID {
+		if err = b.flush(); err != nil {
+			return
+		}
+	}
+	if b.chunk == nil {
+		b.chunk = NewChunk(chunkID)
+	}
+	return b.chunk.Add(snapshot)
+}
+
+func (b *backfiller) Close() error {
+	return b.flush()
+}
+
+// flush merges the current chunk into the chunk file already on disk, if any.
+// Snapshots already stored for the same timestamp are kept.
+func (b *backfiller) flush() error {
+	if b.chunk == nil {
+		return nil
+	}
+	c := b.chunk
+	b.chunk = nil
+
+	if existing, err := b.loadChunk(c.ID()); err == nil {
+		stored := make(map[int64]struct{}, existing.Len())
+		for _, ss := range existing.(*chunk).SortedSnapshots {
+			stored[ss.Timestamp.UnixNano()] = struct{}{}
+		}
+		existing.SetCompleted(false)
+		for _, ss := range c.(*chunk).SortedSnapshots {
+			if _, ok := stored[ss.Timestamp.UnixNano()]; !ok {
+				existing.Add(ss)
+			}
+		}
+		c = existing
+	}
+
+	c.SetCompleted(true)
+	return b.saveChunk(c)
+}
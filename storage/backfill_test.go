@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nghialv/promviz/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBackfiller(t *testing.T) {
+	dir, err := ioutil.TempDir("", "promviz-backfill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	start := time.Unix(ChunkID(time.Now().Add(-time.Hour)), 0)
+
+	// A chunk already written by the server keeps its snapshots.
+	s := &storage{dbDir: dir, logger: zap.NewNop()}
+	existing := NewChunk(ChunkID(start))
+	existing.Add(&model.Snapshot{Timestamp: start, GraphJSON: "server"})
+	existing.SetCompleted(true)
+	require.NoError(t, s.saveChunk(existing))
+
+	b, err := NewBackfiller(dir, zap.NewNop())
+	require.NoError(t, err)
+	for ts := start; ts.Before(start.Add(2 * ChunkLength)); ts = ts.Add(time.Minute) {
+		require.NoError(t, b.Add(&model.Snapshot{Timestamp: ts, GraphJSON: "backfill"}))
+	}
+	assert.Equal(t, ErrBackfillLiveChunk, b.Add(&model.Snapshot{Timestamp: time.Now()}))
+	require.NoError(t, b.Close())
+
+	c, err := s.loadChunk(ChunkID(start))
+	require.NoError(t, err)
+	assert.True(t, c.IsCompleted())
+	assert.Equal(t, 5, c.Len())
+	assert.Equal(t, "server", c.(*chunk).SortedSnapshots[0].GraphJSON)
+
+	c, err = s.loadChunk(ChunkID(start.Add(ChunkLength)))
+	require.NoError(t, err)
+	assert.True(t, c.IsCompleted())
+	assert.Equal(t, 5, c.Len())
+}
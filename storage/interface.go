@@ -7,6 +7,7 @@ import (
 type Storage interface {
 	Appender
 	Querier
+	ConfigHistory
 	Close() error
 }
 
@@ -18,3 +19,8 @@ type Querier interface {
 	GetChunk(int64) (Chunk, error)
 	GetLatestSnapshot() (*model.Snapshot, error)
 }
+
+type ConfigHistory interface {
+	AddConfigRecord(*model.ConfigRecord) error
+	GetConfigHistory() ([]*model.ConfigRecord, error)
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -17,7 +18,10 @@ import (
 	"go.uber.org/zap"
 )
 
-const chunkBlockLength = time.Hour
+const (
+	chunkBlockLength  = time.Hour
+	configHistoryFile = "config_history.json"
+)
 
 var (
 	namespace = "promviz"
@@ -62,7 +66,8 @@ func newStorageMetrics(r prometheus.Registerer) *storageMetrics {
 }
 
 type Options struct {
-	Retention time.Duration
+	Retention         time.Duration
+	ConfigHistorySize int
 }
 
 type storage struct {
@@ -73,6 +78,7 @@ type storage struct {
 
 	latestSnapshot *model.Snapshot
 	latestChunk    Chunk
+	configHistory  []*model.ConfigRecord
 
 	mtx    sync.RWMutex
 	ctx    context.Context
@@ -106,6 +112,13 @@ func Open(path string, logger *zap.Logger, r prometheus.Registerer, opts *Option
 
 	latestChunk.SetCompleted(false)
 	s.latestChunk = latestChunk
+
+	configHistory, err := s.loadConfigHistory()
+	if err != nil {
+		s.logger.Info("Not found config history from disk. (A new one will be created)", zap.Error(err))
+		configHistory = make([]*model.ConfigRecord, 0)
+	}
+	s.configHistory = configHistory
 	go s.Run()
 
 	return s, nil
@@ -186,6 +199,43 @@ func (s *storage) GetLatestSnapshot() (snapshot *model.Snapshot, err error) {
 	return
 }
 
+// AddConfigRecord appends an applied configuration to the history and
+// persists the last ConfigHistorySize records.
+func (s *storage) AddConfigRecord(record *model.ConfigRecord) (err error) {
+	defer track(s.metrics, "AddConfigRecord")(&err)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	select {
+	case <-s.ctx.Done():
+		return ErrDBClosed
+	default:
+	}
+
+	s.configHistory = append(s.configHistory, record)
+	if n := len(s.configHistory) - s.options.ConfigHistorySize; s.options.ConfigHistorySize > 0 && n > 0 {
+		s.configHistory = s.configHistory[n:]
+	}
+
+	if err = s.saveConfigHistory(); err != nil {
+		s.logger.Error("Failed to save config history to disk", zap.Error(err))
+	}
+	return
+}
+
+// GetConfigHistory returns the applied configurations from newest to oldest.
+func (s *storage) GetConfigHistory() (records []*model.ConfigRecord, err error) {
+	defer track(s.metrics, "GetConfigHistory")(&err)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	records = make([]*model.ConfigRecord, 0, len(s.configHistory))
+	for i := len(s.configHistory) - 1; i >= 0; i-- {
+		records = append(records, s.configHistory[i])
+	}
+	return
+}
+
 func (s *storage) Run() {
 	ticker := time.NewTicker(30 * time.Minute)
 	defer func() {
@@ -263,6 +313,31 @@ func (s *storage) loadChunk(chunkID int64) (Chunk, error) {
 	return chunk, nil
 }
 
+func (s *storage) saveConfigHistory() error {
+	data, err := json.Marshal(s.configHistory)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dbDir, configHistoryFile)
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func (s *storage) loadConfigHistory() ([]*model.ConfigRecord, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dbDir, configHistoryFile))
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*model.ConfigRecord, 0)
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
 func chunkPath(dbDir string, chunkID int64) (blockPath string, chunkPath string) {
 	bl := int64(chunkBlockLength.Seconds())
 	blockTs := (chunkID / bl) * bl
@@ -1 +1,54 @@
 package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nghialv/promviz/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestConfigHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "promviz-storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	open := func() Storage {
+		s, err := Open(dir, zap.NewNop(), nil, &Options{Retention: time.Hour, ConfigHistorySize: 2})
+		require.NoError(t, err)
+		return s
+	}
+
+	s := open()
+	records, err := s.GetConfigHistory()
+	require.NoError(t, err)
+	assert.Empty(t, records)
+
+	ts := time.Unix(1600000000, 0).UTC()
+	for i, hash := range []string{"a", "b", "c"} {
+		err := s.AddConfigRecord(&model.ConfigRecord{
+			Timestamp: ts.Add(time.Duration(i) * time.Minute),
+			Hash:      hash,
+			Config:    "graphName: " + hash + "\n",
+			Changes:   []*model.ConfigChange{{Kind: "changed", Path: "graphName", New: hash}},
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+
+	// The last ConfigHistorySize records are loaded back, newest first.
+	s = open()
+	defer s.Close()
+	records, err = s.GetConfigHistory()
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "c", records[0].Hash)
+	assert.Equal(t, "b", records[1].Hash)
+	assert.True(t, ts.Add(2*time.Minute).Equal(records[0].Timestamp))
+	assert.Equal(t, "graphName: c\n", records[0].Config)
+	assert.Equal(t, []*model.ConfigChange{{Kind: "changed", Path: "graphName", New: "c"}}, records[0].Changes)
+}
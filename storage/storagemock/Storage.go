@@ -23,6 +23,20 @@ func (_m *Storage) Add(_a0 *model.Snapshot) error {
 	return r0
 }
 
+// AddConfigRecord provides a mock function with given fields: _a0
+func (_m *Storage) AddConfigRecord(_a0 *model.ConfigRecord) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*model.ConfigRecord) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // Close provides a mock function with given fields:
 func (_m *Storage) Close() error {
 	ret := _m.Called()
@@ -60,6 +74,29 @@ func (_m *Storage) GetChunk(_a0 int64) (storage.Chunk, error) {
 	return r0, r1
 }
 
+// GetConfigHistory provides a mock function with given fields:
+func (_m *Storage) GetConfigHistory() ([]*model.ConfigRecord, error) {
+	ret := _m.Called()
+
+	var r0 []*model.ConfigRecord
+	if rf, ok := ret.Get(0).(func() []*model.ConfigRecord); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*model.ConfigRecord)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetLatestSnapshot provides a mock function with given fields:
 func (_m *Storage) GetLatestSnapshot() (*model.Snapshot, error) {
 	ret := _m.Called()